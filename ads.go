@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strconv"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Aggregated Discovery Service, state of the world variant.
+// Serves the same data as the REST handlers but pushes
+// changes to Envoy as soon as a store is updated.
+type adsServer struct {
+	controller *Controller
+}
+
+func newADSServer(controller *Controller) *adsServer {
+	return &adsServer{controller: controller}
+}
+
+// adsWatch is the state of a single resource type on a stream.
+type adsWatch struct {
+	names   []string
+	version string
+	nonce   string
+	sent    bool
+}
+
+type adsStream struct {
+	stream  discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+	node    *core.Node
+	watches map[string]*adsWatch
+	nonce   uint64
+}
+
+func (s *adsServer) StreamAggregatedResources(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	st := &adsStream{
+		stream:  stream,
+		watches: make(map[string]*adsWatch),
+	}
+
+	reqs := make(chan *v2.DiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		// Grab the update channels before looking at any data
+		// so that no change can slip through unnoticed.
+		configUpdates := s.controller.configStore.Updates()
+		epUpdates := s.controller.epStore.Updates()
+		secretUpdates := s.controller.secretStore.Updates()
+
+		var err error
+		select {
+		case req := <-reqs:
+			err = s.handleRequest(st, req)
+		case <-configUpdates:
+			err = s.pushAll(st)
+		case <-epUpdates:
+			err = s.pushAll(st)
+		case <-secretUpdates:
+			err = s.pushAll(st)
+		case err = <-errs:
+			if err == io.EOF {
+				return nil
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *adsServer) handleRequest(st *adsStream, req *v2.DiscoveryRequest) error {
+	// Only the first request on a stream is required to carry the node
+	if req.Node != nil {
+		st.node = req.Node
+	}
+	if st.node == nil {
+		return status.Error(codes.InvalidArgument, "missing node")
+	}
+
+	w, ok := st.watches[req.TypeUrl]
+	if !ok {
+		w = &adsWatch{}
+		st.watches[req.TypeUrl] = w
+	}
+
+	// Envoy answers to a response we have already superseded
+	if req.ResponseNonce != "" && req.ResponseNonce != w.nonce {
+		return nil
+	}
+
+	if req.ErrorDetail != nil {
+		log.Printf("ads: %s rejected %s version %s: %s",
+			st.node.Id, req.TypeUrl, w.version, req.ErrorDetail.Message)
+		s.controller.nodeStore.Nack(st.node, req.TypeUrl, req.ErrorDetail.Message)
+	} else if req.ResponseNonce != "" {
+		s.controller.nodeStore.Ack(st.node, req.TypeUrl, req.VersionInfo)
+	}
+
+	// A new subscription is answered even if the version didn't change,
+	// e.g. when it adds a name that doesn't exist yet
+	if !sameNames(w.names, req.ResourceNames) {
+		w.sent = false
+	}
+	w.names = req.ResourceNames
+	return s.push(st, req.TypeUrl, w)
+}
+
+// sameNames returns whether a and b hold the same names in any order.
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, name := range b {
+		if !containsString(a, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *adsServer) pushAll(st *adsStream) error {
+	for typeURL, w := range st.watches {
+		if err := s.push(st, typeURL, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push sends the current state of a resource type if it differs
+// from what the stream has been sent already.
+func (s *adsServer) push(st *adsStream, typeURL string, w *adsWatch) error {
+	resp, ok := s.controller.GetResponse(typeURL, st.node, w.names)
+	if !ok {
+		return nil
+	}
+	if w.sent && resp.VersionInfo == w.version {
+		return nil
+	}
+
+	st.nonce++
+	resp.Nonce = strconv.FormatUint(st.nonce, 10)
+	if err := st.stream.Send(resp); err != nil {
+		return err
+	}
+
+	w.version = resp.VersionInfo
+	w.nonce = resp.Nonce
+	w.sent = true
+	s.controller.nodeStore.Sent(st.node, typeURL, w.version)
+	return nil
+}
+
+// fetch answers unary requests of the discovery services
+// that support them, e.g. FetchSecrets.
+func (s *adsServer) fetch(req *v2.DiscoveryRequest) (*v2.DiscoveryResponse, error) {
+	if req.Node == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing node")
+	}
+	resp, _ := s.controller.GetResponse(req.TypeUrl, req.Node, req.ResourceNames)
+	if resp == nil || len(resp.Resources) == 0 {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	return resp, nil
+}
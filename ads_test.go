@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	status "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeADSStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	requests  chan *v2.DiscoveryRequest
+	responses chan *v2.DiscoveryResponse
+}
+
+func newFakeADSStream(ctx context.Context) *fakeADSStream {
+	return &fakeADSStream{
+		ctx:       ctx,
+		requests:  make(chan *v2.DiscoveryRequest, 10),
+		responses: make(chan *v2.DiscoveryResponse, 10),
+	}
+}
+
+func (s *fakeADSStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeADSStream) Send(resp *v2.DiscoveryResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+func (s *fakeADSStream) Recv() (*v2.DiscoveryRequest, error) {
+	select {
+	case req := <-s.requests:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeADSStream) expectResponse(t *testing.T) *v2.DiscoveryResponse {
+	t.Helper()
+	select {
+	case resp := <-s.responses:
+		return resp
+	case <-time.After(time.Second):
+		t.Fatal("expected a response")
+	}
+	return nil
+}
+
+func (s *fakeADSStream) expectNoResponse(t *testing.T) {
+	t.Helper()
+	select {
+	case resp := <-s.responses:
+		t.Fatalf("unexpected response: %v", resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testConfigMap(version string, listener string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{ResourceVersion: version},
+		Data: map[string]string{
+			"listeners": `
+- name: ` + listener + `
+  address:
+    socket_address:
+      address: 0.0.0.0
+      port_value: 10001
+`,
+			"assignments": `
+by-cluster:
+  foo:
+    listeners: [` + listener + `]
+`,
+		},
+	}
+}
+
+func newTestController(t *testing.T) *Controller {
+	c := &Controller{
+		configStore: &ConfigStore{updates: newNotifier()},
+		epStore:     &EpStore{updates: newNotifier()},
+		secretStore: &SecretStore{updates: newNotifier()},
+		nodeStore:   NewNodeStore(),
+	}
+	if err := c.configStore.Load(testConfigMap("1", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestADSPushesConfigUpdates(t *testing.T) {
+	c := newTestController(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := newFakeADSStream(ctx)
+	go newADSServer(c).StreamAggregatedResources(stream)
+
+	node := &core.Node{Id: "a", Cluster: "foo"}
+	stream.requests <- &v2.DiscoveryRequest{Node: node, TypeUrl: resource.ListenerType}
+
+	resp := stream.expectResponse(t)
+	if len(resp.Resources) != 1 || resp.TypeUrl != resource.ListenerType {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+
+	// ACK must not trigger another response
+	stream.requests <- &v2.DiscoveryRequest{
+		TypeUrl:       resource.ListenerType,
+		VersionInfo:   resp.VersionInfo,
+		ResponseNonce: resp.Nonce,
+	}
+	stream.expectNoResponse(t)
+	if status := c.nodeStore.Nodes()["a"].Types[resource.ListenerType]; status.Acked != resp.VersionInfo {
+		t.Fatalf("expected version %s to be acked, got %+v", resp.VersionInfo, status)
+	}
+
+	if err := c.configStore.Load(testConfigMap("2", "bar")); err != nil {
+		t.Fatal(err)
+	}
+	pushed := stream.expectResponse(t)
+	if pushed.VersionInfo == resp.VersionInfo {
+		t.Fatalf("expected a new version to be pushed, got %v", pushed.VersionInfo)
+	}
+}
+
+func TestADSTracksNACK(t *testing.T) {
+	c := newTestController(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := newFakeADSStream(ctx)
+	go newADSServer(c).StreamAggregatedResources(stream)
+
+	node := &core.Node{Id: "a", Cluster: "foo"}
+	stream.requests <- &v2.DiscoveryRequest{Node: node, TypeUrl: resource.ListenerType}
+	resp := stream.expectResponse(t)
+
+	stream.requests <- &v2.DiscoveryRequest{
+		TypeUrl:       resource.ListenerType,
+		ResponseNonce: resp.Nonce,
+		ErrorDetail:   &status.Status{Message: "bad listener"},
+	}
+	stream.expectNoResponse(t)
+
+	s := c.nodeStore.Nodes()["a"].Types[resource.ListenerType]
+	if s.Sent != resp.VersionInfo || s.Acked != "" || s.Rejected != resp.VersionInfo || s.Error != "bad listener" {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+}
+
+func TestADSShortResourceNames(t *testing.T) {
+	c := newTestController(t)
+	c.epStore.LoadEp(testEndpoints("foo", "1", "10.0.0.1"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := newFakeADSStream(ctx)
+	go newADSServer(c).StreamAggregatedResources(stream)
+
+	stream.requests <- &v2.DiscoveryRequest{
+		Node:          &core.Node{Id: "a", Cluster: "foo"},
+		TypeUrl:       resource.EndpointType,
+		ResourceNames: []string{"a", "x/y", "default/foo"},
+	}
+	resp := stream.expectResponse(t)
+	if len(resp.Resources) != 1 {
+		t.Fatalf("expected only default/foo, got %v", resp)
+	}
+}
+
+func TestADSSubscriptionChange(t *testing.T) {
+	c := newTestController(t)
+	if err := c.configStore.Load(&v1.ConfigMap{
+		Data: map[string]string{
+			"routes": testRoutes,
+			"assignments": `
+by-cluster:
+  foo:
+    routes: [foo, bar]
+`,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := newFakeADSStream(ctx)
+	go newADSServer(c).StreamAggregatedResources(stream)
+
+	stream.requests <- &v2.DiscoveryRequest{
+		Node:          &core.Node{Id: "a", Cluster: "foo"},
+		TypeUrl:       resource.RouteType,
+		ResourceNames: []string{"foo"},
+	}
+	resp := stream.expectResponse(t)
+
+	// Subscribing to a route that doesn't exist yet is still answered
+	stream.requests <- &v2.DiscoveryRequest{
+		TypeUrl:       resource.RouteType,
+		VersionInfo:   resp.VersionInfo,
+		ResponseNonce: resp.Nonce,
+		ResourceNames: []string{"foo", "baz"},
+	}
+	resp = stream.expectResponse(t)
+	if len(resp.Resources) != 1 {
+		t.Fatalf("expected only foo, got %v", resp)
+	}
+
+	stream.requests <- &v2.DiscoveryRequest{
+		TypeUrl:       resource.RouteType,
+		VersionInfo:   resp.VersionInfo,
+		ResponseNonce: resp.Nonce,
+		ResourceNames: []string{"baz", "bar", "foo"},
+	}
+	resp = stream.expectResponse(t)
+	if len(resp.Resources) != 2 {
+		t.Fatalf("expected foo and bar, got %v", resp)
+	}
+
+	// ACKs of the same subscription aren't answered
+	stream.requests <- &v2.DiscoveryRequest{
+		TypeUrl:       resource.RouteType,
+		VersionInfo:   resp.VersionInfo,
+		ResponseNonce: resp.Nonce,
+		ResourceNames: []string{"foo", "bar", "baz"},
+	}
+	stream.expectNoResponse(t)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// How often the config file is checked for changes
+const configFileInterval = 5 * time.Second
+
+// Sections of the config, as keys of the config map
+var configSections = []string{"templates", "listeners", "clusters", "services", "routes", "runtime", "assignments"}
+
+// ConfigFileStore keeps the ConfigStore up to date from disk rather than
+// from Kubernetes. The path is either a config map manifest, the same
+// as passed to -validate, or a directory with a file per section:
+//
+//	config/
+//	  listeners.yaml
+//	  clusters.yaml
+//	  assignments.yaml
+//
+// Either is reloaded when it changes, e.g. when the ConfigMap it is
+// mounted from is updated.
+type ConfigFileStore struct {
+	path        string
+	configStore *ConfigStore
+
+	// Sections as last read
+	data map[string]string
+}
+
+func NewConfigFileStore(path string, configStore *ConfigStore) *ConfigFileStore {
+	return &ConfigFileStore{
+		path:        path,
+		configStore: configStore,
+	}
+}
+
+func (fs *ConfigFileStore) Init() error {
+	return fs.Load()
+}
+
+func (fs *ConfigFileStore) Run() {
+	for range time.Tick(configFileInterval) {
+		data := fs.data
+		err := fs.Load()
+		if reflect.DeepEqual(data, fs.data) {
+			if err != nil {
+				log.Printf("%s: %s", fs.path, err)
+			}
+			continue
+		}
+		fs.configStore.lastError = err
+		if err != nil {
+			log.Println("update failed: ", err)
+		} else {
+			log.Println("update applied")
+		}
+	}
+}
+
+// Load reads the config and loads it if it changed since it was last
+// read. An invalid config is rejected, the one loaded before keeps
+// being served.
+func (fs *ConfigFileStore) Load() error {
+	cm, err := readConfigFile(fs.path)
+	if err != nil {
+		return err
+	}
+	if fs.data != nil && reflect.DeepEqual(cm.Data, fs.data) {
+		return nil
+	}
+	// Not read again until it changes, valid or not
+	fs.data = cm.Data
+	return fs.configStore.Load(cm)
+}
+
+// readConfigFile reads a config map manifest, or builds one from the
+// files of a directory named after the sections they hold. Hidden
+// files, as the ones of mounted config maps, are skipped.
+func readConfigFile(path string) (*v1.ConfigMap, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var cm v1.ConfigMap
+		if err := yaml.UnmarshalStrict(raw, &cm); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		return &cm, nil
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	cm := &v1.ConfigMap{Data: make(map[string]string)}
+	cm.Name = filepath.Base(path)
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || file.IsDir() {
+			continue
+		}
+		section := strings.TrimSuffix(name, filepath.Ext(name))
+		if !isConfigSection(section) {
+			return nil, fmt.Errorf("%s: unknown section: %s", path, name)
+		}
+		if _, ok := cm.Data[section]; ok {
+			return nil, fmt.Errorf("%s: %s: already defined", path, section)
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		cm.Data[section] = string(raw)
+	}
+	return cm, nil
+}
+
+func isConfigSection(name string) bool {
+	for _, section := range configSections {
+		if name == section {
+			return true
+		}
+	}
+	return false
+}
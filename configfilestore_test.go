@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+)
+
+func TestConfigDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cm := testConfigMap("1", "foo")
+	write("listeners.yaml", cm.Data["listeners"])
+	write("assignments.yaml", cm.Data["assignments"])
+	// As found in mounted config maps
+	write("..data", "")
+
+	c := NewFileController(ControllerOptions{ConfigFile: dir})
+	node := &core.Node{Id: "a", Cluster: "foo"}
+	if names := c.GetConfigSnapshot().GetClusterNames(node); len(names) != 0 {
+		t.Fatalf("expected no clusters, got %v", names)
+	}
+	cache, ok := c.GetConfigSnapshot().getAssignmentCache(node)
+	if !ok || len(cache.resources[resource.ListenerType]) != 1 {
+		t.Fatal("expected listener foo to be assigned")
+	}
+
+	// Unchanged files aren't loaded again
+	updates := c.configStore.Updates()
+	if err := c.configFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-updates:
+		t.Fatal("unexpected update")
+	default:
+	}
+
+	write("clusters.yaml", `
+- name: bar
+  connect_timeout: 1s
+  type: EDS
+  eds_cluster_config:
+    service_name: default/bar
+    eds_config:
+      ads: {}
+`)
+	write("assignments.yaml", `
+by-cluster:
+  foo:
+    listeners: [foo]
+    clusters: [bar]
+`)
+	if err := c.configFile.Load(); err != nil {
+		t.Fatal(err)
+	}
+	<-updates
+	if names := c.GetConfigSnapshot().GetClusterNames(node); len(names) != 1 || names[0] != "bar" {
+		t.Fatalf("expected cluster bar, got %v", names)
+	}
+	if !c.GetConfigSnapshot().HasService("default/bar") {
+		t.Fatal("expected service default/bar")
+	}
+
+	// Invalid configs are rejected and the previous one kept
+	write("routes.txt", "")
+	write("routes.yaml", "")
+	if err := c.configFile.Load(); err == nil {
+		t.Fatal("expected duplicate section to be rejected")
+	}
+	os.Remove(filepath.Join(dir, "routes.txt"))
+	os.Remove(filepath.Join(dir, "routes.yaml"))
+	write("secrets.yaml", "")
+	if err := c.configFile.Load(); err == nil {
+		t.Fatal("expected unknown section to be rejected")
+	}
+	if !c.GetConfigSnapshot().HasService("default/bar") {
+		t.Fatal("expected previous config to be kept")
+	}
+}
+
+func TestConfigFileManifest(t *testing.T) {
+	f, err := ioutil.TempFile("", "xds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: xds
+  namespace: default
+data:
+  listeners: |
+    - name: foo
+      address:
+        socket_address:
+          address: 0.0.0.0
+          port_value: 10001
+`)
+	f.Close()
+
+	cm, err := readConfigFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Namespace != "default" || cm.Name != "xds" {
+		t.Fatalf("unexpected config map %s/%s", cm.Namespace, cm.Name)
+	}
+	config := NewConfig()
+	if err := config.Load(cm); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.listeners["foo"]; !ok {
+		t.Fatal("expected listener foo")
+	}
+}
@@ -5,14 +5,23 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	"github.com/golang/protobuf/ptypes"
-	"github.com/golang/protobuf/ptypes/any"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/golang/protobuf/proto"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -24,74 +33,308 @@ const (
 	ByClusterKeyPrefix = "c:"
 )
 
+// Clusters can carry settings for xds in their metadata, under this key
+const xdsMetadataKey = "xds"
+
+// Not ready endpoints are drained unless a cluster asks otherwise
+const defaultNotReadyHealth = core.HealthStatus_DRAINING
+
 type Config struct {
 	version   string
 	listeners map[string]*v2.Listener
 	clusters  map[string]*v2.Cluster
+	routes    map[string]*v2.RouteConfiguration
+	runtimes  map[string]*discovery.Runtime
 	rules     *AssignmentRules
+	// Same resources translated to the v3 API
+	listenersV3 map[string]proto.Message
+	clustersV3  map[string]proto.Message
+	routesV3    map[string]proto.Message
+	runtimesV3  map[string]proto.Message
 	// Set type
 	services map[string]struct{}
+	// Set of EDS service names resolved through DNS SRV records
+	dnsServices map[string]struct{}
+	// Health status of not ready endpoints by EDS service name
+	notReadyHealth map[string]core.HealthStatus
+	// Set of secrets referenced by listeners and clusters
+	secrets map[string]struct{}
+	// Custom resource key -> why it was rejected, nil if it was accepted
+	objects map[string]error
 }
 
 // NewConfig initializes config struct.
 func NewConfig() *Config {
 	return &Config{
-		listeners: make(map[string]*v2.Listener),
-		clusters:  make(map[string]*v2.Cluster),
-		services:  make(map[string]struct{}),
+		listeners:   make(map[string]*v2.Listener),
+		clusters:    make(map[string]*v2.Cluster),
+		routes:      make(map[string]*v2.RouteConfiguration),
+		runtimes:    make(map[string]*discovery.Runtime),
+		listenersV3: make(map[string]proto.Message),
+		clustersV3:  make(map[string]proto.Message),
+		routesV3:    make(map[string]proto.Message),
+		runtimesV3:  make(map[string]proto.Message),
+		services:    make(map[string]struct{}),
+		dnsServices: make(map[string]struct{}),
+		secrets:     make(map[string]struct{}),
+		objects:     make(map[string]error),
+
+		notReadyHealth: make(map[string]core.HealthStatus),
 	}
 }
 
 // Load fills config from config map.
 func (config *Config) Load(cm *v1.ConfigMap) error {
-	config.version = cm.ObjectMeta.ResourceVersion
+	return config.LoadAll([]*v1.ConfigMap{cm}, nil)
+}
+
+// LoadAll fills config from config maps and xds custom resources. The
+// config maps are merged, a resource or assignment may only be defined
+// in one of them. Unlike config maps, custom resources are accepted or
+// rejected one by one, why each of them was rejected is kept for their
+// status.
+func (config *Config) LoadAll(cms []*v1.ConfigMap, objects []*unstructured.Unstructured) error {
+	// Resource or assignment -> config map defining it
+	origins := make(map[string]string)
+	rules := &AssignmentRules{
+		ByNodeId:  make(map[string]*Assignment),
+		ByCluster: make(map[string]*Assignment),
+	}
+	versions := make([]string, len(cms))
+	for i, cm := range cms {
+		if err := config.loadConfigMap(cm, origins, rules); err != nil {
+			if len(cms) > 1 {
+				return fmt.Errorf("%s/%s: %s", cm.Namespace, cm.Name, err)
+			}
+			return err
+		}
+		versions[i] = cm.Namespace + "/" + cm.Name + "=" + cm.ObjectMeta.ResourceVersion
+	}
+	config.version = cms[0].ObjectMeta.ResourceVersion
+	if len(cms) > 1 {
+		config.version = combineVersions(versions)
+	}
+
+	config.loadResourceObjects(objects)
+
+	config.rules = rules
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	config.loadAssignmentObjects(objects)
+	return nil
+}
+
+// loadConfigMap adds the resources and assignments of a config map,
+// recording where they come from in origins.
+func (config *Config) loadConfigMap(cm *v1.ConfigMap, origins map[string]string, rules *AssignmentRules) error {
+	origin := cm.Namespace + "/" + cm.Name
+	define := func(section string, name string) error {
+		key := section + ": " + name
+		if other, ok := origins[key]; ok && other != origin {
+			return fmt.Errorf("%s: already defined in %s", key, other)
+		}
+		origins[key] = origin
+		return nil
+	}
+
+	templates, err := extractTemplates(cm)
+	if err != nil {
+		return err
+	}
+
+	listeners, err := extractListeners(cm, templates)
+	if err != nil {
+		return err
+	}
+
+	clusters, err := extractClusters(cm, templates)
+	if err != nil {
+		return err
+	}
+
+	routes, err := extractRoutes(cm)
+	if err != nil {
+		return err
+	}
 
-	listeners, err := extractListeners(cm)
+	runtimes, err := extractRuntimes(cm)
 	if err != nil {
 		return err
 	}
 
-	clusters, err := extractClusters(cm)
+	assignments, err := extractAssignments(cm)
+	if err != nil {
+		return err
+	}
+
+	services, err := extractServices(cm)
 	if err != nil {
 		return err
 	}
 
 	for _, listener := range listeners {
-		log.Printf("loading listener %s", listener.Name)
-		config.listeners[listener.Name] = listener
+		if err := define("listeners", listener.Name); err != nil {
+			return err
+		}
+		if err := config.addListener(listener); err != nil {
+			return fmt.Errorf("listeners: %s: %s", listener.Name, err)
+		}
 	}
 
 	for _, cluster := range clusters {
-		log.Printf("loading cluster %s", cluster.Name)
-		if cluster.GetType() == v2.Cluster_EDS {
-			edsClusterConfig := cluster.EdsClusterConfig
-			if edsClusterConfig == nil {
-				d, _ := yaml.Marshal(cluster)
-				log.Printf("not found expected `eds_cluster_config` section; see parsed YAML:\n\n%s\n", d)
-				continue
-			}
+		if err := define("clusters", cluster.Name); err != nil {
+			return err
+		}
+		if err := config.addCluster(cluster); err != nil {
+			return fmt.Errorf("clusters: %s: %s", cluster.Name, err)
+		}
+	}
 
-			serviceName := edsClusterConfig.ServiceName
-			if serviceName[:4] == "k8s:" {
-				serviceName = serviceName[4:]
-			}
-			config.services[serviceName] = struct{}{}
+	for _, service := range services {
+		listener, cluster, err := service.Resources()
+		if err != nil {
+			return fmt.Errorf("services: %s: %s", service.Name, err)
+		}
+		if err := define("listeners", listener.Name); err != nil {
+			return err
+		}
+		if err := define("clusters", cluster.Name); err != nil {
+			return err
+		}
+		if _, ok := config.listeners[listener.Name]; ok {
+			return fmt.Errorf("services: %s: listener already defined", service.Name)
+		}
+		if _, ok := config.clusters[cluster.Name]; ok {
+			return fmt.Errorf("services: %s: cluster already defined", service.Name)
+		}
+		if err := config.addListener(listener); err != nil {
+			return fmt.Errorf("services: %s: %s", service.Name, err)
+		}
+		if err := config.addCluster(cluster); err != nil {
+			return fmt.Errorf("services: %s: %s", service.Name, err)
 		}
-		config.clusters[cluster.Name] = cluster
 	}
 
-	assignments, err := extractAssignments(cm)
+	for _, route := range routes {
+		if err := define("routes", route.Name); err != nil {
+			return err
+		}
+		if err := config.addRoute(route); err != nil {
+			return fmt.Errorf("routes: %s: %s", route.Name, err)
+		}
+	}
+
+	for _, runtime := range runtimes {
+		if err := define("runtime", runtime.Name); err != nil {
+			return err
+		}
+		if err := config.addRuntime(runtime); err != nil {
+			return fmt.Errorf("runtime: %s: %s", runtime.Name, err)
+		}
+	}
+
+	for id, assignment := range assignments.ByNodeId {
+		if err := define("assignments: by-node-id", id); err != nil {
+			return err
+		}
+		rules.ByNodeId[id] = assignment
+	}
+	for cluster, assignment := range assignments.ByCluster {
+		if err := define("assignments: by-cluster", cluster); err != nil {
+			return err
+		}
+		rules.ByCluster[cluster] = assignment
+	}
+	return nil
+}
+
+func (config *Config) addListener(listener *v2.Listener) error {
+	log.Printf("loading listener %s", listener.Name)
+	listenerV3, err := toV3(listener)
 	if err != nil {
 		return err
 	}
+	config.listeners[listener.Name] = listener
+	config.listenersV3[listener.Name] = listenerV3
+	for _, name := range findSecretNames(listener) {
+		config.secrets[name] = struct{}{}
+	}
+	return nil
+}
 
-	config.rules = assignments
-	if err := config.validate(); err != nil {
+func (config *Config) addCluster(cluster *v2.Cluster) error {
+	log.Printf("loading cluster %s", cluster.Name)
+	eds := cluster.GetType() == v2.Cluster_EDS
+	var serviceName string
+	health := defaultNotReadyHealth
+	if eds {
+		edsClusterConfig := cluster.EdsClusterConfig
+		if edsClusterConfig == nil {
+			d, _ := yaml.Marshal(cluster)
+			log.Printf("not found expected `eds_cluster_config` section; see parsed YAML:\n\n%s\n", d)
+			return nil
+		}
+
+		serviceName = strings.TrimPrefix(edsClusterConfig.ServiceName, "k8s:")
+		var err error
+		if health, err = clusterNotReadyHealth(cluster); err != nil {
+			return err
+		}
+		if other, ok := config.notReadyHealth[serviceName]; ok && other != health {
+			return fmt.Errorf("conflicting not_ready for %s", serviceName)
+		}
+		if serviceName == dnsSRVPrefix {
+			return fmt.Errorf("missing SRV name in %s", serviceName)
+		}
+		if serviceName == fileServicePrefix {
+			return fmt.Errorf("missing service name in %s", serviceName)
+		}
+	}
+	clusterV3, err := toV3(cluster)
+	if err != nil {
 		return err
 	}
 
+	if eds {
+		config.notReadyHealth[serviceName] = health
+		if strings.HasPrefix(serviceName, dnsSRVPrefix) {
+			config.dnsServices[serviceName] = struct{}{}
+		} else if !strings.HasPrefix(serviceName, fileServicePrefix) {
+			// Endpoints are watched per service, whichever port is picked
+			serviceName, _ = splitServicePort(serviceName)
+			config.services[serviceName] = struct{}{}
+		}
+	}
+	config.clusters[cluster.Name] = cluster
+	config.clustersV3[cluster.Name] = clusterV3
+	for _, name := range findSecretNames(cluster) {
+		config.secrets[name] = struct{}{}
+	}
 	return nil
+}
 
+func (config *Config) addRoute(route *v2.RouteConfiguration) error {
+	log.Printf("loading route %s", route.Name)
+	routeV3, err := toV3(route)
+	if err != nil {
+		return err
+	}
+	config.routes[route.Name] = route
+	config.routesV3[route.Name] = routeV3
+	return nil
+}
+
+func (config *Config) addRuntime(runtime *discovery.Runtime) error {
+	log.Printf("loading runtime layer %s", runtime.Name)
+	runtimeV3, err := toV3(runtime)
+	if err != nil {
+		return err
+	}
+	config.runtimes[runtime.Name] = runtime
+	config.runtimesV3[runtime.Name] = runtimeV3
+	return nil
 }
 
 func (c *Config) HasService(name string) bool {
@@ -99,6 +342,49 @@ func (c *Config) HasService(name string) bool {
 	return ok
 }
 
+// DNSServices returns the EDS service names resolved through DNS SRV
+// records, sorted.
+func (c *Config) DNSServices() []string {
+	names := make([]string, 0, len(c.dnsServices))
+	for name := range c.dnsServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NotReadyHealth returns the health status not ready endpoints of an
+// EDS service are served with.
+func (c *Config) NotReadyHealth(name string) core.HealthStatus {
+	if health, ok := c.notReadyHealth[name]; ok {
+		return health
+	}
+	return defaultNotReadyHealth
+}
+
+func (c *Config) HasSecret(name string) bool {
+	_, ok := c.secrets[name]
+	return ok
+}
+
+// GetSecretNames returns the names the node is allowed to fetch, i.e.
+// those referenced by its listeners and clusters.
+func (c *Config) GetSecretNames(node *core.Node, names []string) []string {
+	cache, ok := c.getAssignmentCache(node)
+	if !ok {
+		return nil
+	}
+	rv := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := cache.secrets[name]; ok {
+			rv = append(rv, name)
+		} else {
+			log.Printf("%s is not allowed to fetch secret %s", node.Id, name)
+		}
+	}
+	return rv
+}
+
 func (c *Config) getAssignmentCache(node *core.Node) (*assignmentCache, bool) {
 	a, ok := c.rules.cache[ByNodeIdKeyPrefix+node.Id]
 	if !ok {
@@ -108,19 +394,64 @@ func (c *Config) getAssignmentCache(node *core.Node) (*assignmentCache, bool) {
 }
 
 func (c *Config) GetListeners(node *core.Node) ([]byte, bool) {
-	if cache, ok := c.getAssignmentCache(node); ok {
-		return cache.listeners, true
-	}
-	return nil, false
+	return c.GetJSON(resource.ListenerType, node)
 }
 
 func (c *Config) GetClusters(node *core.Node) ([]byte, bool) {
+	return c.GetJSON(resource.ClusterType, node)
+}
+
+// GetJSON returns the REST DiscoveryResponse for the given resource type.
+func (c *Config) GetJSON(typeURL string, node *core.Node) ([]byte, bool) {
 	if cache, ok := c.getAssignmentCache(node); ok {
-		return cache.clusters, true
+		b, ok := cache.json[typeURL]
+		return b, ok
 	}
 	return nil, false
 }
 
+// GetResponse returns the resources of the given type assigned to the
+// node as a DiscoveryResponse. When names are given, only resources
+// with these names are included.
+func (c *Config) GetResponse(typeURL string, node *core.Node, names []string) (*v2.DiscoveryResponse, bool) {
+	cache, ok := c.getAssignmentCache(node)
+	if !ok {
+		return nil, false
+	}
+	resources, ok := cache.resources[typeURL]
+	if !ok {
+		return nil, false
+	}
+	version := cache.versions[typeURL]
+	if len(names) > 0 {
+		resources = filterResources(resources, names)
+		version = resourcesVersion(resources)
+	}
+	return &v2.DiscoveryResponse{
+		VersionInfo: version,
+		Resources:   resourcesToAny(resources),
+		TypeUrl:     typeURL,
+	}, true
+}
+
+// GetResources returns the resources of the given type assigned to the
+// node keyed by name, each carrying its own version, for incremental xDS.
+func (c *Config) GetResources(typeURL string, node *core.Node) (map[string]*v2.Resource, bool) {
+	cache, ok := c.getAssignmentCache(node)
+	if !ok {
+		return nil, false
+	}
+	resources, ok := cache.resources[typeURL]
+	if !ok {
+		return nil, false
+	}
+	rv := make(map[string]*v2.Resource, len(resources))
+	for _, r := range resources {
+		rv[r.Name] = r
+	}
+	return rv, true
+}
+
 func (c *Config) GetClusterNames(node *core.Node) []string {
 	result := make([]string, 0)
 
@@ -138,6 +469,8 @@ func (c *Config) GetClusterNames(node *core.Node) []string {
 type Assignment struct {
 	Listeners []string `json:"listeners"`
 	Clusters  []string `json:"clusters"`
+	Routes    []string `json:"routes"`
+	Runtime   []string `json:"runtime"`
 }
 
 type AssignmentRules struct {
@@ -147,9 +480,29 @@ type AssignmentRules struct {
 	cache map[string]*assignmentCache
 }
 
+// Everything served to nodes of an assignment, keyed by type URL
 type assignmentCache struct {
-	listeners []byte
-	clusters  []byte
+	// Content based version of the resources
+	versions map[string]string
+	// Encoded DiscoveryResponses for the REST handlers
+	json map[string][]byte
+	// Resources for the gRPC server
+	resources map[string][]*v2.Resource
+	// Secrets the assignment may fetch
+	secrets map[string]struct{}
+}
+
+// set stores the resources of a type. Their version is derived from
+// what is served, so nodes only see a new version if their own
+// resources changed, not on every configmap update.
+func (cache *assignmentCache) set(typeURL string, resources []*v2.Resource) {
+	version := resourcesVersion(resources)
+	cache.versions[typeURL] = version
+	cache.resources[typeURL] = resources
+	cache.json[typeURL], _ = structToJSON(&v2.DiscoveryResponse{
+		VersionInfo: version,
+		Resources:   resourcesToAny(resources),
+	})
 }
 
 type ConfigStore struct {
@@ -160,11 +513,27 @@ type ConfigStore struct {
 	informer cache.SharedIndexInformer
 	store    cache.Store
 
+	// Further config maps, in any namespace, selected by label
+	selector         string
+	selectedInformer cache.SharedIndexInformer
+	selectedStore    cache.Store
+
+	// Serializes loading
+	loadMu sync.Mutex
+	// xds custom resources, loaded along with the config map
+	objects []*unstructured.Unstructured
+	// Why each of them was rejected, as of the latest load, whether its
+	// Config was kept or not
+	objectErrors map[string]error
+
+	mu        sync.RWMutex
 	config    *Config
 	configMap *v1.ConfigMap
 
 	lastUpdate time.Time
 	lastError  error
+
+	updates *notifier
 }
 
 func (cs *ConfigStore) InitFromK8s() error {
@@ -176,39 +545,136 @@ func (cs *ConfigStore) InitFromK8s() error {
 		return err
 	}
 	cs.store.Add(cm)
+
+	if cs.selector != "" {
+		cms, err := cs.k8sClient.CoreV1().ConfigMaps(v1.NamespaceAll).List(metav1.ListOptions{
+			LabelSelector: cs.selector,
+		})
+		if err != nil {
+			return err
+		}
+		for i := range cms.Items {
+			cs.selectedStore.Add(&cms.Items[i])
+		}
+	}
 	return cs.Load(cm)
 }
 
 func (cs *ConfigStore) Run() {
+	if cs.selectedInformer != nil {
+		go cs.selectedInformer.Run(nil)
+	}
 	cs.informer.Run(nil)
 }
 
 func (cs *ConfigStore) Load(cm *v1.ConfigMap) error {
+	cs.loadMu.Lock()
+	defer cs.loadMu.Unlock()
+	return cs.load(cm, cs.objects)
+}
+
+// LoadObjects replaces the xds custom resources loaded along with the
+// config map.
+func (cs *ConfigStore) LoadObjects(objects []*unstructured.Unstructured) error {
+	cs.loadMu.Lock()
+	defer cs.loadMu.Unlock()
+	cs.objects = objects
+	if cs.configMap == nil {
+		return nil
+	}
+	return cs.load(cs.configMap, objects)
+}
+
+// Reload loads the config map again, along with the current selected
+// config maps.
+func (cs *ConfigStore) Reload() error {
+	cs.loadMu.Lock()
+	defer cs.loadMu.Unlock()
+	if cs.configMap == nil {
+		return nil
+	}
+	return cs.load(cs.configMap, cs.objects)
+}
+
+// selectedConfigMaps returns the config maps matching the selector
+// besides cm, sorted by key.
+func (cs *ConfigStore) selectedConfigMaps(cm *v1.ConfigMap) []*v1.ConfigMap {
+	if cs.selectedStore == nil {
+		return nil
+	}
+	var rv []*v1.ConfigMap
+	for _, obj := range cs.selectedStore.List() {
+		selected := obj.(*v1.ConfigMap)
+		if selected.Namespace == cm.Namespace && selected.Name == cm.Name {
+			continue
+		}
+		rv = append(rv, selected)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Namespace != rv[j].Namespace {
+			return rv[i].Namespace < rv[j].Namespace
+		}
+		return rv[i].Name < rv[j].Name
+	})
+	return rv
+}
+
+func (cs *ConfigStore) load(cm *v1.ConfigMap, objects []*unstructured.Unstructured) error {
 	defer func() {
 		cs.lastUpdate = time.Now()
 	}()
-	configSnapshot := cs.config
-	cs.config = NewConfig()
-	if err := cs.config.Load(cm); err != nil {
-		// Restore previously loaded Config
-		cs.config = configSnapshot
+	config := NewConfig()
+	cms := append([]*v1.ConfigMap{cm}, cs.selectedConfigMaps(cm)...)
+	if err := config.LoadAll(cms, objects); err != nil {
+		// Keep previously loaded Config, but let the custom resources
+		// know they aren't served
+		cs.mu.Lock()
+		cs.objectErrors = rejectedObjects(config, objects, err)
+		cs.mu.Unlock()
 		return err
 	}
+	cs.mu.Lock()
+	cs.config = config
 	cs.configMap = cm
+	cs.objectErrors = config.objects
+	cs.mu.Unlock()
+	cs.updates.Notify()
 	return nil
 }
 
 func (cs *ConfigStore) GetConfigSnapshot() *Config {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
 	return cs.config
 }
 
+// ObjectError returns why a custom resource was rejected by the latest
+// load, and false if it wasn't loaded at all. Unlike the one of the
+// Config snapshot, it covers loads that failed as a whole.
+func (cs *ConfigStore) ObjectError(key string) (error, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	err, ok := cs.objectErrors[key]
+	return err, ok
+}
+
+// Updates returns a channel that is closed once a new Config is loaded.
+func (cs *ConfigStore) Updates() <-chan struct{} {
+	return cs.updates.Wait()
+}
+
+// NewConfigStore watches the config map configName, and with selector
+// also all config maps matching it, to be merged into the former.
 func NewConfigStore(
 	k8sClient *kubernetes.Clientset,
 	configName string,
+	selector string,
 ) *ConfigStore {
 	cs := &ConfigStore{
 		configName: configName,
 		k8sClient:  k8sClient,
+		selector:   selector,
+		updates:    newNotifier(),
 	}
 
 	namespace, _ := k8sSplitName(configName)
@@ -237,10 +703,42 @@ func NewConfigStore(
 			}
 		},
 	})
+
+	if selector == "" {
+		return cs
+	}
+	selectedFactory := informers.NewSharedInformerFactoryWithOptions(k8sClient, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = selector
+		}))
+	cs.selectedInformer = selectedFactory.Core().V1().ConfigMaps().Informer()
+	cs.selectedStore = cs.selectedInformer.GetStore()
+	reload := func() {
+		cs.lastError = cs.Reload()
+		if cs.lastError != nil {
+			log.Println("update failed: ", cs.lastError)
+		} else {
+			log.Println("update applied")
+		}
+	}
+	cs.selectedInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			reload()
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			if reflect.DeepEqual(old, cur) {
+				return
+			}
+			reload()
+		},
+		DeleteFunc: func(obj interface{}) {
+			reload()
+		},
+	})
 	return cs
 }
 
-func extractListeners(cm *v1.ConfigMap) ([]*v2.Listener, error) {
+func extractListeners(cm *v1.ConfigMap, templates Templates) ([]*v2.Listener, error) {
 	// We have to decode our input, which is YAML, so we can iterate
 	// over each of them.
 	raw, err := unmarshalYAMLSlice([]byte(cm.Data["listeners"]))
@@ -249,8 +747,12 @@ func extractListeners(cm *v1.ConfigMap) ([]*v2.Listener, error) {
 	}
 	rv := make([]*v2.Listener, len(raw))
 	for i, r := range raw {
+		r, err := templates.Expand(r)
+		if err != nil {
+			return nil, fmt.Errorf("listeners: index %d: %s", i, err)
+		}
 		var pb v2.Listener
-		if err := convertToPb(r, &pb); err != nil {
+		if err := convertToPbAnyVersion(r, &pb, &listenerv3.Listener{}); err != nil {
 			d, _ := yaml.Marshal(r)
 			return nil, errors.New(fmt.Sprintf("listeners: index %d: %s:\n\n%s", i, err, d))
 		}
@@ -259,7 +761,7 @@ func extractListeners(cm *v1.ConfigMap) ([]*v2.Listener, error) {
 	return rv, nil
 }
 
-func extractClusters(cm *v1.ConfigMap) ([]*v2.Cluster, error) {
+func extractClusters(cm *v1.ConfigMap, templates Templates) ([]*v2.Cluster, error) {
 	// We have to decode our input, which is YAML, so we can iterate
 	// over each of them.
 	raw, err := unmarshalYAMLSlice([]byte(cm.Data["clusters"]))
@@ -268,8 +770,12 @@ func extractClusters(cm *v1.ConfigMap) ([]*v2.Cluster, error) {
 	}
 	rv := make([]*v2.Cluster, len(raw))
 	for i, r := range raw {
+		r, err := templates.Expand(r)
+		if err != nil {
+			return nil, fmt.Errorf("clusters: index %d: %s", i, err)
+		}
 		var pb v2.Cluster
-		if err := convertToPb(r, &pb); err != nil {
+		if err := convertToPbAnyVersion(r, &pb, &clusterv3.Cluster{}); err != nil {
 			d, _ := yaml.Marshal(r)
 			return nil, errors.New(fmt.Sprintf("clusters: index %d: %s:\n\n%s", i, err, d))
 		}
@@ -278,6 +784,60 @@ func extractClusters(cm *v1.ConfigMap) ([]*v2.Cluster, error) {
 	return rv, nil
 }
 
+func extractRoutes(cm *v1.ConfigMap) ([]*v2.RouteConfiguration, error) {
+	// We have to decode our input, which is YAML, so we can iterate
+	// over each of them.
+	raw, err := unmarshalYAMLSlice([]byte(cm.Data["routes"]))
+	if err != nil {
+		return nil, errors.New("routes: invalid YAML: " + err.Error())
+	}
+	rv := make([]*v2.RouteConfiguration, len(raw))
+	for i, r := range raw {
+		var pb v2.RouteConfiguration
+		if err := convertToPbAnyVersion(r, &pb, &routev3.RouteConfiguration{}); err != nil {
+			d, _ := yaml.Marshal(r)
+			return nil, errors.New(fmt.Sprintf("routes: index %d: %s:\n\n%s", i, err, d))
+		}
+		rv[i] = &pb
+	}
+	return rv, nil
+}
+
+func extractRuntimes(cm *v1.ConfigMap) ([]*discovery.Runtime, error) {
+	// We have to decode our input, which is YAML, so we can iterate
+	// over each of them.
+	raw, err := unmarshalYAMLSlice([]byte(cm.Data["runtime"]))
+	if err != nil {
+		return nil, errors.New("runtime: invalid YAML: " + err.Error())
+	}
+	rv := make([]*discovery.Runtime, len(raw))
+	for i, r := range raw {
+		var pb discovery.Runtime
+		if err := convertToPb(r, &pb); err != nil {
+			d, _ := yaml.Marshal(r)
+			return nil, errors.New(fmt.Sprintf("runtime: index %d: %s:\n\n%s", i, err, d))
+		}
+		rv[i] = &pb
+	}
+	return rv, nil
+}
+
+// clusterNotReadyHealth returns the health status the cluster wants
+// not ready endpoints to have, set through `not_ready` in its xds metadata.
+func clusterNotReadyHealth(cluster *v2.Cluster) (core.HealthStatus, error) {
+	value, ok := cluster.GetMetadata().GetFilterMetadata()[xdsMetadataKey].GetFields()["not_ready"]
+	if !ok {
+		return defaultNotReadyHealth, nil
+	}
+	switch value.GetStringValue() {
+	case "DRAINING":
+		return core.HealthStatus_DRAINING, nil
+	case "UNHEALTHY":
+		return core.HealthStatus_UNHEALTHY, nil
+	}
+	return 0, fmt.Errorf("not_ready must be DRAINING or UNHEALTHY, not %q", value.GetStringValue())
+}
+
 func extractAssignments(cm *v1.ConfigMap) (*AssignmentRules, error) {
 	var ar AssignmentRules
 	err := yaml.Unmarshal([]byte(cm.Data["assignments"]), &ar)
@@ -288,69 +848,88 @@ func (config *Config) validate() error {
 	config.rules.cache = make(map[string]*assignmentCache)
 
 	for key, assignment := range config.rules.ByNodeId {
-		lr := make([]*any.Any, len(assignment.Listeners))
-		cache := &assignmentCache{}
-		for i, name := range assignment.Listeners {
-			if listener, ok := config.listeners[name]; !ok {
-				return errors.New("missing listener: " + name)
-			} else {
-				r, _ := ptypes.MarshalAny(listener)
-				lr[i] = r
-			}
+		cache, err := config.buildAssignmentCache(assignment)
+		if err != nil {
+			return err
 		}
-		cache.listeners, _ = structToJSON(&v2.DiscoveryResponse{
-			VersionInfo: config.version,
-			Resources:   lr,
-		})
+		config.rules.cache[ByNodeIdKeyPrefix+key] = cache
+	}
 
-		cr := make([]*any.Any, len(assignment.Clusters))
-		for i, name := range assignment.Clusters {
-			if cluster, ok := config.clusters[name]; !ok {
-				return errors.New("unknown cluster: " + name)
-			} else {
-				r, _ := ptypes.MarshalAny(cluster)
-				cr[i] = r
-			}
+	for key, assignment := range config.rules.ByCluster {
+		cache, err := config.buildAssignmentCache(assignment)
+		if err != nil {
+			return err
 		}
-		cache.clusters, _ = structToJSON(&v2.DiscoveryResponse{
-			VersionInfo: config.version,
-			Resources:   cr,
-		})
+		config.rules.cache[ByClusterKeyPrefix+key] = cache
+	}
+	return nil
+}
 
-		config.rules.cache[ByNodeIdKeyPrefix+key] = cache
+func (config *Config) buildAssignmentCache(assignment *Assignment) (*assignmentCache, error) {
+	cache := &assignmentCache{
+		versions:  make(map[string]string),
+		json:      make(map[string][]byte),
+		resources: make(map[string][]*v2.Resource),
+		secrets:   make(map[string]struct{}),
 	}
 
-	for key, assignment := range config.rules.ByCluster {
-		lr := make([]*any.Any, len(assignment.Listeners))
-		cache := &assignmentCache{}
-		for i, name := range assignment.Listeners {
-			if listener, ok := config.listeners[name]; !ok {
-				return errors.New("missing listener: " + name)
-			} else {
-				r, _ := ptypes.MarshalAny(listener)
-				lr[i] = r
+	lr := make([]*v2.Resource, len(assignment.Listeners))
+	lrV3 := make([]*v2.Resource, len(assignment.Listeners))
+	for i, name := range assignment.Listeners {
+		if listener, ok := config.listeners[name]; !ok {
+			return nil, errors.New("missing listener: " + name)
+		} else {
+			lr[i] = newResource(name, listener)
+			lrV3[i] = newResource(name, config.listenersV3[name])
+			for _, secret := range findSecretNames(listener) {
+				cache.secrets[secret] = struct{}{}
 			}
 		}
-		cache.listeners, _ = structToJSON(&v2.DiscoveryResponse{
-			VersionInfo: config.version,
-			Resources:   lr,
-		})
-
-		cr := make([]*any.Any, len(assignment.Clusters))
-		for i, name := range assignment.Clusters {
-			if cluster, ok := config.clusters[name]; !ok {
-				return errors.New("unknown cluster: " + name)
-			} else {
-				r, _ := ptypes.MarshalAny(cluster)
-				cr[i] = r
+	}
+	cache.set(resource.ListenerType, lr)
+	cache.set(resourcev3.ListenerType, lrV3)
+
+	cr := make([]*v2.Resource, len(assignment.Clusters))
+	crV3 := make([]*v2.Resource, len(assignment.Clusters))
+	for i, name := range assignment.Clusters {
+		if cluster, ok := config.clusters[name]; !ok {
+			return nil, errors.New("unknown cluster: " + name)
+		} else {
+			cr[i] = newResource(name, cluster)
+			crV3[i] = newResource(name, config.clustersV3[name])
+			for _, secret := range findSecretNames(cluster) {
+				cache.secrets[secret] = struct{}{}
 			}
 		}
-		cache.clusters, _ = structToJSON(&v2.DiscoveryResponse{
-			VersionInfo: config.version,
-			Resources:   cr,
-		})
-
-		config.rules.cache[ByClusterKeyPrefix+key] = cache
 	}
-	return nil
+	cache.set(resource.ClusterType, cr)
+	cache.set(resourcev3.ClusterType, crV3)
+
+	rr := make([]*v2.Resource, len(assignment.Routes))
+	rrV3 := make([]*v2.Resource, len(assignment.Routes))
+	for i, name := range assignment.Routes {
+		if route, ok := config.routes[name]; !ok {
+			return nil, errors.New("unknown route: " + name)
+		} else {
+			rr[i] = newResource(name, route)
+			rrV3[i] = newResource(name, config.routesV3[name])
+		}
+	}
+	cache.set(resource.RouteType, rr)
+	cache.set(resourcev3.RouteType, rrV3)
+
+	rtr := make([]*v2.Resource, len(assignment.Runtime))
+	rtrV3 := make([]*v2.Resource, len(assignment.Runtime))
+	for i, name := range assignment.Runtime {
+		if runtime, ok := config.runtimes[name]; !ok {
+			return nil, errors.New("unknown runtime layer: " + name)
+		} else {
+			rtr[i] = newResource(name, runtime)
+			rtrV3[i] = newResource(name, config.runtimesV3[name])
+		}
+	}
+	cache.set(resource.RuntimeType, rtr)
+	cache.set(resourcev3.RuntimeType, rtrV3)
+
+	return cache, nil
 }
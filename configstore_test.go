@@ -0,0 +1,290 @@
+package main
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	redisproxy "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/redis_proxy/v2"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/golang/protobuf/ptypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testRoutes = `
+- name: foo
+  virtual_hosts:
+  - name: foo
+    domains: ["*"]
+    routes:
+    - match: {prefix: /}
+      route: {cluster: foo}
+- name: bar
+  virtual_hosts:
+  - name: bar
+    domains: ["*"]
+    routes:
+    - match: {prefix: /}
+      route: {cluster: bar}
+`
+
+func TestConfigRoutes(t *testing.T) {
+	config := NewConfig()
+	err := config.Load(&v1.ConfigMap{
+		Data: map[string]string{
+			"routes": testRoutes,
+			"assignments": `
+by-cluster:
+  foo:
+    routes: [foo, bar]
+`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &core.Node{Cluster: "foo"}
+	resp, ok := config.GetResponse(resource.RouteType, node, []string{"bar"})
+	if !ok {
+		t.Fatal("missing routes")
+	}
+	if len(resp.Resources) != 1 {
+		t.Fatalf("expected only the requested route, got %v", resp.Resources)
+	}
+
+	resp, _ = config.GetResponse(resource.RouteType, node, nil)
+	if len(resp.Resources) != 2 {
+		t.Fatalf("expected all assigned routes, got %v", resp.Resources)
+	}
+}
+
+func TestConfigUnknownRoute(t *testing.T) {
+	config := NewConfig()
+	err := config.Load(&v1.ConfigMap{
+		Data: map[string]string{
+			"routes": testRoutes,
+			"assignments": `
+by-cluster:
+  foo:
+    routes: [baz]
+`,
+		},
+	})
+	if err == nil || err.Error() != "unknown route: baz" {
+		t.Fatalf("expected unknown route error, got %v", err)
+	}
+}
+
+func TestConfigRuntime(t *testing.T) {
+	config := NewConfig()
+	err := config.Load(&v1.ConfigMap{
+		Data: map[string]string{
+			"runtime": `
+- name: flags
+  layer:
+    health_check.min_interval: 10
+    feature.enabled: true
+`,
+			"assignments": `
+by-node-id:
+  a:
+    runtime: [flags]
+`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typeURL := range []string{resource.RuntimeType, resourcev3.RuntimeType} {
+		resp, ok := config.GetResponse(typeURL, &core.Node{Id: "a"}, []string{"flags"})
+		if !ok || len(resp.Resources) != 1 || resp.Resources[0].TypeUrl != typeURL {
+			t.Fatalf("expected the flags layer as %s, got %v", typeURL, resp)
+		}
+	}
+}
+
+func TestConfigMapsMerged(t *testing.T) {
+	base := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "xds"},
+		Data: map[string]string{
+			"routes": testRoutes,
+		},
+	}
+	team := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "snuba", Name: "xds"},
+		Data: map[string]string{
+			"assignments": `
+by-cluster:
+  snuba:
+    routes: [foo]
+`,
+		},
+	}
+	config := NewConfig()
+	if err := config.LoadAll([]*v1.ConfigMap{base, team}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.GetResponse(resource.RouteType, &core.Node{Cluster: "snuba"}, nil); !ok {
+		t.Fatal("expected snuba to be assigned a route of another configmap")
+	}
+
+	team.Data["routes"] = testRoutes
+	err := NewConfig().LoadAll([]*v1.ConfigMap{base, team}, nil)
+	if err == nil || err.Error() != "snuba/xds: routes: foo: already defined in default/xds" {
+		t.Fatalf("expected conflicting routes, got %v", err)
+	}
+}
+
+func TestConfigTemplates(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"templates": `
+eds-tcp:
+  connect_timeout: 0.25s
+  type: EDS
+  eds_cluster_config:
+    service_name: "{{service}}"
+    eds_config:
+      ads: {}
+tcp-proxy:
+  address:
+    socket_address:
+      address: 0.0.0.0
+      port_value: "{{port}}"
+  filter_chains:
+  - filters:
+    - name: envoy.tcp_proxy
+      typed_config:
+        '@type': type.googleapis.com/envoy.config.filter.network.tcp_proxy.v2.TcpProxy
+        cluster: "{{cluster}}"
+        stat_prefix: "tcp_{{cluster}}"
+`,
+			"listeners": `
+- {template: tcp-proxy, name: foo, port: 10001, cluster: foo}
+`,
+			"clusters": `
+- {template: eds-tcp, name: foo, service: default/foo}
+- name: bar
+  connect_timeout: 1s
+  type: STATIC
+`,
+		},
+	}
+	config := NewConfig()
+	if err := config.Load(cm); err != nil {
+		t.Fatal(err)
+	}
+	if name := config.clusters["foo"].GetEdsClusterConfig().GetServiceName(); name != "default/foo" {
+		t.Fatalf("expected service default/foo, got %q", name)
+	}
+	if !config.HasService("default/foo") {
+		t.Fatal("expected expanded cluster to be watched")
+	}
+	if port := config.listeners["foo"].GetAddress().GetSocketAddress().GetPortValue(); port != 10001 {
+		t.Fatalf("expected port 10001, got %d", port)
+	}
+
+	for clusters, expected := range map[string]string{
+		`[{template: nope, name: foo}]`:                                    "clusters: index 0: unknown template: nope",
+		`[{template: eds-tcp, name: foo}]`:                                 "clusters: index 0: template eds-tcp: missing parameter: service",
+		`[{template: eds-tcp, name: foo, service: default/foo, port: 80}]`: "clusters: index 0: template eds-tcp: unused parameters: [port]",
+	} {
+		cm.Data["clusters"] = clusters
+		if err := NewConfig().Load(cm); err == nil || err.Error() != expected {
+			t.Fatalf("expected %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestConfigServices(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"services": `
+- service: default/snuba
+  port: 10001
+  protocol: http
+- service: default/redis
+  port: 6379
+  protocol: redis
+  op_timeout: 1s
+- name: clickhouse
+  service: default/clickhouse:native
+  port: 9000
+  protocol: tcp
+`,
+			"routes": testRoutes,
+			"assignments": `
+by-cluster:
+  snuba:
+    listeners: [snuba, redis, clickhouse]
+    clusters: [snuba, redis, clickhouse]
+`,
+		},
+	}
+	config := NewConfig()
+	if err := config.Load(cm); err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range []string{"default/snuba", "default/redis", "default/clickhouse"} {
+		if !config.HasService(service) {
+			t.Fatalf("expected service %s", service)
+		}
+	}
+	if port := config.listeners["redis"].GetAddress().GetSocketAddress().GetPortValue(); port != 6379 {
+		t.Fatalf("expected port 6379, got %d", port)
+	}
+	if source := config.clusters["snuba"].GetEdsClusterConfig().GetEdsConfig().GetApiConfigSource(); source.GetApiType() != core.ApiConfigSource_REST || source.GetClusterNames()[0] != "xds_cluster" {
+		t.Fatalf("expected EDS over REST from xds_cluster, got %v", source)
+	}
+	if name := config.listeners["redis"].FilterChains[0].Filters[0].Name; name != "envoy.filters.network.redis_proxy" {
+		t.Fatalf("expected envoy.filters.network.redis_proxy, got %s", name)
+	}
+	var redis redisproxy.RedisProxy
+	if err := ptypes.UnmarshalAny(config.listeners["redis"].FilterChains[0].Filters[0].GetTypedConfig(), &redis); err != nil {
+		t.Fatal(err)
+	}
+	if timeout := redis.GetSettings().GetOpTimeout().GetSeconds(); timeout != 1 {
+		t.Fatalf("expected op_timeout 1s, got %ds", timeout)
+	}
+	for _, typeURL := range []string{resource.ListenerType, resourcev3.ListenerType} {
+		resp, ok := config.GetResponse(typeURL, &core.Node{Cluster: "snuba"}, nil)
+		if !ok || len(resp.Resources) != 3 {
+			t.Fatalf("expected generated listeners as %s, got %v", typeURL, resp)
+		}
+	}
+
+	// Clusters referenced by hand written routes
+	cm.Data["services"] = `
+- service: default/foo
+  port: 10002
+  protocol: http
+  route: foo
+`
+	cm.Data["assignments"] = `
+by-cluster:
+  snuba:
+    listeners: [foo]
+    clusters: [foo]
+    routes: [foo]
+`
+	if err := NewConfig().Load(cm); err != nil {
+		t.Fatal(err)
+	}
+
+	for services, expected := range map[string]string{
+		`[{service: default/foo, port: 80, protocol: udp}]`:                                                `services: foo: protocol must be tcp, http or redis, not "udp"`,
+		`[{service: default/foo, protocol: tcp}]`:                                                          "services: foo: invalid port: 0",
+		`[{service: default/foo, port: 80, protocol: tcp, route: foo}]`:                                    "services: foo: route requires protocol http, not tcp",
+		`[{service: default/foo, port: 80, protocol: http, op_timeout: 1s}]`:                               "services: foo: op_timeout requires protocol redis, not http",
+		`[{service: "dns-srv:_redis._tcp.example.com", port: 80, protocol: tcp}]`:                          "services: index 0: name required",
+		`[{service: default/foo, port: 80, protocol: tcp}, {service: other/foo, port: 81, protocol: tcp}]`: "services: foo: listener already defined",
+	} {
+		cm.Data["services"] = services
+		if err := NewConfig().Load(cm); err == nil || err.Error() != expected {
+			t.Fatalf("expected %q, got %v", expected, err)
+		}
+	}
+}
@@ -1,39 +1,255 @@
 package main
 
 import (
+	"fmt"
+	"net"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
+// EndpointSource keeps the EpStore up to date. Kubernetes is always one
+// of them, others serve backends living outside of it.
+type EndpointSource interface {
+	Init() error
+	Run()
+}
+
 type Controller struct {
 	k8sClient *kubernetes.Clientset
 
 	configStore *ConfigStore
+	crdStore    *CrdStore
 	epStore     *EpStore
+	epSources   []EndpointSource
+	topology    *TopologyStore
+	pods        *PodStore
+	secretStore *SecretStore
+	nodeStore   *NodeStore
+	// Config read from disk instead of Kubernetes
+	configFile *ConfigFileStore
+	// Topology and pods of remote Kubernetes clusters
+	remoteStores []EndpointSource
 }
 
+// ControllerOptions configures the stores of a Controller.
+type ControllerOptions struct {
+	// Config map in form {namespace}/{name}
+	ConfigName string
+	// Label selector of further config maps merged into ConfigName
+	ConfigSelector string
+	// Config map manifest, or directory of sections, read instead of
+	// Kubernetes
+	ConfigFile string
+	// Load xds custom resources in the namespace of the config map
+	CRDs bool
+	// Read endpoints from EndpointSlices rather than Endpoints
+	EndpointSlices bool
+	// Group endpoints by the zone of their node, which watches Nodes
+	Zones bool
+	// Take the weight of endpoints from the annotation of their pod
+	PodWeights bool
+	// Pod labels copied into endpoint metadata
+	LbLabels []string
+	// File with endpoints of services outside of Kubernetes
+	EndpointsFile string
+	// Looks up services named `dns-srv:...`
+	Resolver *net.Resolver
+	// Further Kubernetes clusters whose endpoints are merged in
+	Remotes []RemoteCluster
+	// Holds back updates that drop too many endpoints, if set
+	Guard *EpGuard
+	// Coalesces bursts of endpoint updates, if set
+	Debounce *Debouncer
+}
+
+// NewController sets up all stores, reading config and endpoints from
+// Kubernetes and the other sources set in opts.
 func NewController(
 	k8sClient *kubernetes.Clientset,
-	configName string,
+	dynamicClient dynamic.Interface,
+	opts ControllerOptions,
 ) *Controller {
 	c := &Controller{
 		k8sClient:   k8sClient,
-		configStore: NewConfigStore(k8sClient, configName),
+		configStore: NewConfigStore(k8sClient, opts.ConfigName, opts.ConfigSelector),
+		nodeStore:   NewNodeStore(),
 	}
 
 	if err := c.configStore.InitFromK8s(); err != nil {
 		panic(err)
 	}
 
-	c.epStore = NewEpStore(k8sClient, c.configStore)
-	if err := c.epStore.Init(); err != nil {
+	if opts.CRDs {
+		namespace, _ := k8sSplitName(opts.ConfigName)
+		c.crdStore = NewCrdStore(dynamicClient, namespace, c.configStore)
+		if err := c.crdStore.Init(); err != nil {
+			panic(err)
+		}
+	}
+
+	if opts.Zones {
+		c.topology = NewTopologyStore(k8sClient)
+		if err := c.topology.Init(); err != nil {
+			panic(err)
+		}
+	}
+
+	// Pods are only watched if endpoints take anything over from them
+	watchPods := opts.PodWeights || len(opts.LbLabels) > 0
+	if watchPods {
+		c.pods = NewPodStore(k8sClient, opts.PodWeights, opts.LbLabels)
+		if err := c.pods.Init(); err != nil {
+			panic(err)
+		}
+	}
+
+	var source EndpointSource
+	c.epStore, source = newK8sEpSource(k8sClient, dynamicClient, c.configStore,
+		c.topology, c.pods, opts.EndpointSlices, opts.Guard, opts.Debounce)
+	c.epSources = append(c.epSources, source)
+
+	if len(opts.Remotes) > 0 {
+		merger := NewEpMerger(c.epStore)
+		c.epStore.merger = merger
+		for i, remote := range opts.Remotes {
+			var topology *TopologyStore
+			if opts.Zones {
+				topology = NewTopologyStore(remote.Client)
+				if err := topology.Init(); err != nil {
+					panic(fmt.Errorf("%s: %s", remote.Name, err))
+				}
+				c.remoteStores = append(c.remoteStores, topology)
+			}
+			var pods *PodStore
+			if watchPods {
+				pods = NewPodStore(remote.Client, opts.PodWeights, opts.LbLabels)
+				if err := pods.Init(); err != nil {
+					panic(fmt.Errorf("%s: %s", remote.Name, err))
+				}
+				c.remoteStores = append(c.remoteStores, pods)
+			}
+
+			// Updates are debounced by service, the same in every cluster
+			debounce := opts.Debounce
+			if debounce != nil {
+				debounce = NewDebouncer(debounce.window, debounce.maxDelay)
+			}
+			// Dropped endpoints are guarded once merged
+			epStore, source := newK8sEpSource(remote.Client, remote.DynamicClient, c.configStore,
+				topology, pods, opts.EndpointSlices, nil, debounce)
+			epStore.cluster = i + 1
+			epStore.merger = merger
+			c.epSources = append(c.epSources, source)
+		}
+	}
+	if opts.EndpointsFile != "" {
+		c.epSources = append(c.epSources, NewEpFileStore(opts.EndpointsFile, c.epStore))
+	}
+	c.epSources = append(c.epSources, NewEpDNSStore(opts.Resolver, c.configStore, c.epStore))
+	for _, source := range c.epSources {
+		if err := source.Init(); err != nil {
+			panic(err)
+		}
+	}
+
+	c.secretStore = NewSecretStore(k8sClient, c.configStore)
+	if err := c.secretStore.Init(); err != nil {
 		panic(err)
 	}
 	return c
 }
 
+// NewFileController sets up stores that run without Kubernetes. The
+// config is read from opts.ConfigFile, endpoints from opts.EndpointsFile
+// if set and from DNS for services named `dns-srv:...`. There is no
+// topology nor secrets.
+func NewFileController(opts ControllerOptions) *Controller {
+	c := &Controller{
+		configStore: &ConfigStore{updates: newNotifier()},
+		secretStore: &SecretStore{updates: newNotifier()},
+		nodeStore:   NewNodeStore(),
+	}
+
+	c.configFile = NewConfigFileStore(opts.ConfigFile, c.configStore)
+	if err := c.configFile.Init(); err != nil {
+		panic(err)
+	}
+
+	c.epStore = &EpStore{
+		configStore: c.configStore,
+		guard:       opts.Guard,
+		debounce:    opts.Debounce,
+		updates:     newNotifier(),
+	}
+	if opts.EndpointsFile != "" {
+		c.epSources = append(c.epSources, NewEpFileStore(opts.EndpointsFile, c.epStore))
+	}
+	c.epSources = append(c.epSources, NewEpDNSStore(opts.Resolver, c.configStore, c.epStore))
+	for _, source := range c.epSources {
+		if err := source.Init(); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+// newK8sEpSource sets up the EpStore of a Kubernetes cluster, along
+// with the source reading its Endpoints or EndpointSlices.
+func newK8sEpSource(
+	k8sClient *kubernetes.Clientset,
+	dynamicClient dynamic.Interface,
+	configStore *ConfigStore,
+	topology *TopologyStore,
+	pods *PodStore,
+	endpointSlices bool,
+	guard *EpGuard,
+	debounce *Debouncer,
+) (*EpStore, EndpointSource) {
+	if endpointSlices {
+		epStore := &EpStore{
+			configStore: configStore,
+			topology:    topology,
+			pods:        pods,
+			guard:       guard,
+			debounce:    debounce,
+			updates:     newNotifier(),
+		}
+		return epStore, NewEpSliceStore(dynamicClient, configStore, epStore)
+	}
+	epStore := NewEpStore(k8sClient, configStore, topology, pods, guard, debounce)
+	return epStore, epStore
+}
+
 func (c *Controller) Run() {
+	if c.configFile != nil {
+		go c.configFile.Run()
+		for _, source := range c.epSources {
+			go source.Run()
+		}
+		return
+	}
 	go c.configStore.Run()
-	go c.epStore.Run()
+	if c.crdStore != nil {
+		go c.crdStore.Run()
+	}
+	if c.topology != nil {
+		go c.topology.Run()
+	}
+	if c.pods != nil {
+		go c.pods.Run()
+	}
+	for _, store := range c.remoteStores {
+		go store.Run()
+	}
+	for _, source := range c.epSources {
+		go source.Run()
+	}
+	go c.secretStore.Run()
 }
 
 func (c *Controller) GetEndpoints(cluster string) (*Endpoints, bool) {
@@ -43,3 +259,36 @@ func (c *Controller) GetEndpoints(cluster string) (*Endpoints, bool) {
 func (c *Controller) GetConfigSnapshot() *Config {
 	return c.configStore.GetConfigSnapshot()
 }
+
+// GetResponse returns the current resources of the given type for node.
+// names is only used for resource types that are requested by name.
+func (c *Controller) GetResponse(typeURL string, node *core.Node, names []string) (*v2.DiscoveryResponse, bool) {
+	switch typeURL {
+	case resource.ListenerType, resource.ClusterType, resource.RouteType, resource.RuntimeType,
+		resourcev3.ListenerType, resourcev3.ClusterType, resourcev3.RouteType, resourcev3.RuntimeType:
+		return c.GetConfigSnapshot().GetResponse(typeURL, node, names)
+	case resource.EndpointType, resourcev3.EndpointType:
+		return c.epStore.GetResponse(typeURL, names), true
+	case resource.SecretType, resourcev3.SecretType:
+		names = c.GetConfigSnapshot().GetSecretNames(node, names)
+		return c.secretStore.GetResponse(typeURL, names), true
+	}
+	return nil, false
+}
+
+// GetResources returns the current resources of the given type for node
+// keyed by name. names is only used for resource types that are
+// requested by name.
+func (c *Controller) GetResources(typeURL string, node *core.Node, names []string) (map[string]*v2.Resource, bool) {
+	switch typeURL {
+	case resource.ListenerType, resource.ClusterType, resource.RouteType, resource.RuntimeType,
+		resourcev3.ListenerType, resourcev3.ClusterType, resourcev3.RouteType, resourcev3.RuntimeType:
+		return c.GetConfigSnapshot().GetResources(typeURL, node)
+	case resource.EndpointType, resourcev3.EndpointType:
+		return c.epStore.GetResources(typeURL, names), true
+	case resource.SecretType, resourcev3.SecretType:
+		names = c.GetConfigSnapshot().GetSecretNames(node, names)
+		return c.secretStore.GetResources(typeURL, names), true
+	}
+	return nil, false
+}
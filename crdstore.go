@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	xdsListenerKind   = "XdsListener"
+	xdsRouteKind      = "XdsRoute"
+	xdsClusterKind    = "XdsCluster"
+	xdsAssignmentKind = "XdsAssignment"
+
+	acceptedCondition = "Accepted"
+
+	// Changes to custom resources are loaded once they settled
+	crdSyncWindow   = time.Second
+	crdSyncMaxDelay = 5 * time.Second
+)
+
+// xds custom resources, in the order they are loaded
+var crdResources = []struct {
+	kind     string
+	resource schema.GroupVersionResource
+}{
+	{xdsListenerKind, crdResource("xdslisteners")},
+	{xdsRouteKind, crdResource("xdsroutes")},
+	{xdsClusterKind, crdResource("xdsclusters")},
+	{xdsAssignmentKind, crdResource("xdsassignments")},
+}
+
+func crdResource(resource string) schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    "xds.sentry.io",
+		Version:  "v1alpha1",
+		Resource: resource,
+	}
+}
+
+// Spec of an XdsAssignment, which assigns resources to either the node
+// with the given id or all nodes of a cluster.
+type xdsAssignmentSpec struct {
+	ByNodeId  string `json:"by-node-id,omitempty"`
+	ByCluster string `json:"by-cluster,omitempty"`
+	Assignment
+}
+
+type crdStatus struct {
+	Conditions []crdCondition `json:"conditions,omitempty"`
+}
+
+type crdCondition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+}
+
+func objectKey(obj *unstructured.Unstructured) string {
+	return obj.GetKind() + ":" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// objectSpec returns the Envoy resource in the spec of a custom
+// resource, named after it unless it has a name of its own.
+func objectSpec(obj *unstructured.Unstructured) map[string]interface{} {
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	if _, ok := spec["name"]; !ok {
+		spec["name"] = obj.GetName()
+	}
+	return spec
+}
+
+// ObjectError returns why a custom resource was rejected, and false if
+// it wasn't loaded at all.
+func (c *Config) ObjectError(key string) (error, bool) {
+	err, ok := c.objects[key]
+	return err, ok
+}
+
+// rejectedObjects returns why each custom resource isn't served when
+// the config failed to load with err: its own error if it had one, err
+// otherwise.
+func rejectedObjects(config *Config, objects []*unstructured.Unstructured, err error) map[string]error {
+	rv := make(map[string]error, len(objects))
+	for _, obj := range objects {
+		key := objectKey(obj)
+		if objErr := config.objects[key]; objErr != nil {
+			rv[key] = objErr
+		} else {
+			rv[key] = fmt.Errorf("config not loaded: %s", err)
+		}
+	}
+	return rv
+}
+
+// loadResourceObjects adds listeners, routes and clusters from custom
+// resources. They may not replace those of the config map, or those of
+// older custom resources.
+func (config *Config) loadResourceObjects(objects []*unstructured.Unstructured) {
+	for _, obj := range objects {
+		var err error
+		switch obj.GetKind() {
+		case xdsListenerKind:
+			err = config.loadListenerObject(obj)
+		case xdsRouteKind:
+			err = config.loadRouteObject(obj)
+		case xdsClusterKind:
+			err = config.loadClusterObject(obj)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("%s: %s", objectKey(obj), err)
+		}
+		config.objects[objectKey(obj)] = err
+	}
+}
+
+// loadAssignmentObjects adds assignments from custom resources, once
+// all resources they may refer to are loaded.
+func (config *Config) loadAssignmentObjects(objects []*unstructured.Unstructured) {
+	for _, obj := range objects {
+		if obj.GetKind() != xdsAssignmentKind {
+			continue
+		}
+		err := config.loadAssignmentObject(obj)
+		if err != nil {
+			log.Printf("%s: %s", objectKey(obj), err)
+		}
+		config.objects[objectKey(obj)] = err
+	}
+}
+
+func (config *Config) loadListenerObject(obj *unstructured.Unstructured) error {
+	var pb v2.Listener
+	if err := convertToPbAnyVersion(objectSpec(obj), &pb, &listenerv3.Listener{}); err != nil {
+		return err
+	}
+	if _, ok := config.listeners[pb.Name]; ok {
+		return fmt.Errorf("listener %s already exists", pb.Name)
+	}
+	return config.addListener(&pb)
+}
+
+func (config *Config) loadRouteObject(obj *unstructured.Unstructured) error {
+	var pb v2.RouteConfiguration
+	if err := convertToPbAnyVersion(objectSpec(obj), &pb, &routev3.RouteConfiguration{}); err != nil {
+		return err
+	}
+	if _, ok := config.routes[pb.Name]; ok {
+		return fmt.Errorf("route %s already exists", pb.Name)
+	}
+	return config.addRoute(&pb)
+}
+
+func (config *Config) loadClusterObject(obj *unstructured.Unstructured) error {
+	var pb v2.Cluster
+	if err := convertToPbAnyVersion(objectSpec(obj), &pb, &clusterv3.Cluster{}); err != nil {
+		return err
+	}
+	if _, ok := config.clusters[pb.Name]; ok {
+		return fmt.Errorf("cluster %s already exists", pb.Name)
+	}
+	return config.addCluster(&pb)
+}
+
+func (config *Config) loadAssignmentObject(obj *unstructured.Unstructured) error {
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	j, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	var assignment xdsAssignmentSpec
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&assignment); err != nil {
+		return err
+	}
+
+	var key string
+	switch {
+	case assignment.ByNodeId != "" && assignment.ByCluster != "":
+		return errors.New("only one of by-node-id and by-cluster may be set")
+	case assignment.ByNodeId != "":
+		key = ByNodeIdKeyPrefix + assignment.ByNodeId
+	case assignment.ByCluster != "":
+		key = ByClusterKeyPrefix + assignment.ByCluster
+	default:
+		return errors.New("one of by-node-id and by-cluster must be set")
+	}
+	if _, ok := config.rules.cache[key]; ok {
+		return fmt.Errorf("%s%s is already assigned", assignment.ByNodeId, assignment.ByCluster)
+	}
+
+	cache, err := config.buildAssignmentCache(&assignment.Assignment)
+	if err != nil {
+		return err
+	}
+	config.rules.cache[key] = cache
+	if assignment.ByNodeId != "" {
+		if config.rules.ByNodeId == nil {
+			config.rules.ByNodeId = make(map[string]*Assignment)
+		}
+		config.rules.ByNodeId[assignment.ByNodeId] = &assignment.Assignment
+	} else {
+		if config.rules.ByCluster == nil {
+			config.rules.ByCluster = make(map[string]*Assignment)
+		}
+		config.rules.ByCluster[assignment.ByCluster] = &assignment.Assignment
+	}
+	return nil
+}
+
+// CrdStore feeds xds custom resources in the namespace of the config map
+// into the ConfigStore, so that teams can own their resources rather than
+// all editing the same config map. Each resource reports whether it was
+// accepted through the Accepted condition in its status.
+type CrdStore struct {
+	client    dynamic.Interface
+	namespace string
+
+	configStore *ConfigStore
+
+	// Informers and their stores, along crdResources
+	informers []cache.SharedIndexInformer
+	stores    []cache.Store
+
+	// Coalesces the events of a change to many resources into one load
+	debounce *Debouncer
+}
+
+func NewCrdStore(client dynamic.Interface, namespace string, configStore *ConfigStore) *CrdStore {
+	cs := &CrdStore{
+		client:      client,
+		namespace:   namespace,
+		configStore: configStore,
+		debounce:    NewDebouncer(crdSyncWindow, crdSyncMaxDelay),
+	}
+
+	for _, r := range crdResources {
+		resource := client.Resource(r.resource).Namespace(namespace)
+		informer := cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					return resource.List(options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					return resource.Watch(options)
+				},
+			},
+			&unstructured.Unstructured{},
+			0,
+			cache.Indexers{},
+		)
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				cs.queueSync()
+			},
+			UpdateFunc: func(old, cur interface{}) {
+				// Status updates, e.g. our own, leave the generation alone
+				if old.(*unstructured.Unstructured).GetGeneration() == cur.(*unstructured.Unstructured).GetGeneration() {
+					return
+				}
+				cs.queueSync()
+			},
+			DeleteFunc: func(obj interface{}) {
+				cs.queueSync()
+			},
+		})
+		cs.informers = append(cs.informers, informer)
+		cs.stores = append(cs.stores, informer.GetStore())
+	}
+	return cs
+}
+
+func (cs *CrdStore) Init() error {
+	for i, r := range crdResources {
+		list, err := cs.client.Resource(r.resource).Namespace(cs.namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("%s: %s", r.kind, err)
+		}
+		for j := range list.Items {
+			cs.stores[i].Add(&list.Items[j])
+		}
+	}
+	cs.Sync()
+	cs.SyncStatuses()
+	return nil
+}
+
+func (cs *CrdStore) Run() {
+	for _, informer := range cs.informers {
+		go informer.Run(nil)
+	}
+	// The initial list adds every resource, loaded at once here rather
+	// than one by one
+	cache.WaitForCacheSync(nil, cs.hasSynced)
+	cs.Sync()
+
+	// Acceptance also depends on the config map and other resources
+	for {
+		updates := cs.configStore.Updates()
+		cs.SyncStatuses()
+		<-updates
+	}
+}
+
+func (cs *CrdStore) hasSynced() bool {
+	for _, informer := range cs.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// queueSync loads the custom resources once they stopped changing for
+// a bit. Events of the initial list are left to Run.
+func (cs *CrdStore) queueSync() {
+	if !cs.hasSynced() {
+		return
+	}
+	cs.debounce.Do("", cs.Sync)
+}
+
+// Sync loads all custom resources into the ConfigStore, kind by kind
+// and the oldest ones first, so that these win conflicts.
+func (cs *CrdStore) Sync() {
+	var objects []*unstructured.Unstructured
+	for _, store := range cs.stores {
+		start := len(objects)
+		for _, obj := range store.List() {
+			objects = append(objects, obj.(*unstructured.Unstructured))
+		}
+		kind := objects[start:]
+		sort.Slice(kind, func(i, j int) bool {
+			a, b := kind[i], kind[j]
+			if ta, tb := a.GetCreationTimestamp(), b.GetCreationTimestamp(); !ta.Equal(&tb) {
+				return ta.Before(&tb)
+			}
+			return a.GetName() < b.GetName()
+		})
+	}
+	if err := cs.configStore.LoadObjects(objects); err != nil {
+		log.Println("custom resources not loaded: ", err)
+		// No new Config to wait for, which would sync them
+		cs.SyncStatuses()
+	}
+}
+
+// SyncStatuses updates the Accepted condition of every custom resource
+// that changed its mind.
+func (cs *CrdStore) SyncStatuses() {
+	for i, r := range crdResources {
+		resource := cs.client.Resource(r.resource).Namespace(cs.namespace)
+		for _, obj := range cs.stores[i].List() {
+			obj := obj.(*unstructured.Unstructured)
+			err, ok := cs.configStore.ObjectError(objectKey(obj))
+			if !ok {
+				continue
+			}
+			status, changed := objectStatus(obj, err)
+			if !changed {
+				continue
+			}
+			patch, _ := json.Marshal(map[string]interface{}{"status": status})
+			if _, err := resource.Patch(obj.GetName(), types.MergePatchType, patch, metav1.UpdateOptions{}, "status"); err != nil {
+				log.Printf("%s: updating status: %s", objectKey(obj), err)
+			}
+		}
+	}
+}
+
+// objectStatus returns the status of a custom resource that was loaded
+// with err, and whether it differs from its current one.
+func objectStatus(obj *unstructured.Unstructured, err error) (crdStatus, bool) {
+	cond := crdCondition{
+		Type:               acceptedCondition,
+		Status:             string(v1.ConditionTrue),
+		ObservedGeneration: obj.GetGeneration(),
+		LastTransitionTime: metav1.NewTime(time.Now()),
+		Reason:             "Accepted",
+	}
+	if err != nil {
+		cond.Status = string(v1.ConditionFalse)
+		cond.Reason = "Invalid"
+		cond.Message = err.Error()
+	}
+
+	var current crdStatus
+	if m, ok, _ := unstructured.NestedMap(obj.Object, "status"); ok {
+		runtime.DefaultUnstructuredConverter.FromUnstructured(m, &current)
+	}
+	for _, old := range current.Conditions {
+		if old.Type != acceptedCondition || old.Status != cond.Status {
+			continue
+		}
+		cond.LastTransitionTime = old.LastTransitionTime
+		if old.ObservedGeneration == cond.ObservedGeneration &&
+			old.Reason == cond.Reason && old.Message == cond.Message {
+			return current, false
+		}
+	}
+	return crdStatus{Conditions: []crdCondition{cond}}, true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func testObject(kind, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetKind(kind)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetGeneration(1)
+	return obj
+}
+
+func TestCustomResourcesAcceptedOneByOne(t *testing.T) {
+	c := newTestController(t)
+	objects := []*unstructured.Unstructured{
+		testObject(xdsClusterKind, "snuba", map[string]interface{}{
+			"type":            "STATIC",
+			"connect_timeout": "1s",
+		}),
+		testObject(xdsClusterKind, "typo", map[string]interface{}{
+			"tpye": "STATIC",
+		}),
+		// Already defined by the configmap
+		testObject(xdsListenerKind, "foo", map[string]interface{}{}),
+		testObject(xdsAssignmentKind, "snuba", map[string]interface{}{
+			"by-cluster": "snuba",
+			"clusters":   []interface{}{"snuba"},
+		}),
+		testObject(xdsAssignmentKind, "broken", map[string]interface{}{
+			"by-cluster": "broken",
+			"clusters":   []interface{}{"typo"},
+		}),
+	}
+	if err := c.configStore.LoadObjects(objects); err != nil {
+		t.Fatal(err)
+	}
+
+	config := c.GetConfigSnapshot()
+	for _, obj := range objects {
+		err, ok := config.ObjectError(objectKey(obj))
+		if !ok {
+			t.Fatalf("%s not loaded", objectKey(obj))
+		}
+		accepted := obj.GetName() == "snuba"
+		if accepted != (err == nil) {
+			t.Fatalf("%s: unexpected error: %v", objectKey(obj), err)
+		}
+	}
+
+	resp, ok := config.GetResponse(resource.ClusterType, &core.Node{Cluster: "snuba"}, nil)
+	if !ok || len(resp.Resources) != 1 {
+		t.Fatalf("expected snuba to be assigned its cluster: %v", resp)
+	}
+	// The configmap is still served as before
+	if _, ok := config.GetResponse(resource.ListenerType, &core.Node{Cluster: "foo"}, nil); !ok {
+		t.Fatal("expected foo to keep its listeners")
+	}
+
+	// Reloading the configmap keeps the custom resources
+	if err := c.configStore.Load(testConfigMap("2", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.GetConfigSnapshot().GetResponse(resource.ClusterType, &core.Node{Cluster: "snuba"}, nil); !ok {
+		t.Fatal("expected snuba to still be assigned")
+	}
+}
+
+func TestCustomResourcesRejectedTogether(t *testing.T) {
+	c := newTestController(t)
+	cm := testConfigMap("2", "foo")
+	cm.Data["assignments"] = `
+by-cluster:
+  foo:
+    listeners: [foo]
+    clusters: [snuba]
+`
+	snuba := testObject(xdsClusterKind, "snuba", map[string]interface{}{
+		"type":            "STATIC",
+		"connect_timeout": "1s",
+	})
+	if err := c.configStore.LoadObjects([]*unstructured.Unstructured{snuba}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.configStore.Load(cm); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config map relies on snuba, which breaks
+	broken := testObject(xdsClusterKind, "snuba", map[string]interface{}{
+		"tpye": "STATIC",
+	})
+	other := testObject(xdsListenerKind, "bar", map[string]interface{}{})
+	if err := c.configStore.LoadObjects([]*unstructured.Unstructured{broken, other}); err == nil {
+		t.Fatal("expected config to be rejected")
+	}
+	if err, ok := c.configStore.ObjectError(objectKey(broken)); !ok || err == nil || strings.HasPrefix(err.Error(), "config not loaded") {
+		t.Fatalf("expected snuba to be rejected for itself: %v", err)
+	}
+	if err, ok := c.configStore.ObjectError(objectKey(other)); !ok || err == nil || !strings.HasPrefix(err.Error(), "config not loaded") {
+		t.Fatalf("expected bar not to be served: %v", err)
+	}
+	// The previous config is still served
+	if err, _ := c.GetConfigSnapshot().ObjectError(objectKey(snuba)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCustomResourceStatus(t *testing.T) {
+	obj := testObject(xdsClusterKind, "snuba", nil)
+	status, changed := objectStatus(obj, nil)
+	if !changed || status.Conditions[0].Status != "True" {
+		t.Fatalf("expected to be accepted: %v", status)
+	}
+
+	// Unchanged conditions aren't written again
+	obj.Object["status"] = map[string]interface{}{
+		"conditions": []interface{}{map[string]interface{}{
+			"type":               acceptedCondition,
+			"status":             "True",
+			"observedGeneration": int64(1),
+			"lastTransitionTime": "2020-01-01T00:00:00Z",
+			"reason":             "Accepted",
+		}},
+	}
+	if _, changed := objectStatus(obj, nil); changed {
+		t.Fatal("expected status to be unchanged")
+	}
+
+	status, changed = objectStatus(obj, errors.New("unknown cluster: typo"))
+	cond := status.Conditions[0]
+	if !changed || cond.Status != "False" || cond.Message != "unknown cluster: typo" {
+		t.Fatalf("expected to be rejected: %v", status)
+	}
+	if !cond.LastTransitionTime.After(metav1.Now().AddDate(-1, 0, 0)) {
+		t.Fatalf("expected a new transition time: %v", cond.LastTransitionTime)
+	}
+}
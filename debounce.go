@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Debouncer coalesces bursts of updates per key, e.g. the endpoint
+// changes of a rolling deploy. An update runs once no other one for
+// the same key came in for window, but at most maxDelay after the
+// first one of the burst. Only the latest update of a burst runs.
+type Debouncer struct {
+	window   time.Duration
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingUpdate
+}
+
+type pendingUpdate struct {
+	first time.Time
+	timer *time.Timer
+	fn    func()
+}
+
+func NewDebouncer(window time.Duration, maxDelay time.Duration) *Debouncer {
+	return &Debouncer{
+		window:   window,
+		maxDelay: maxDelay,
+		pending:  make(map[string]*pendingUpdate),
+	}
+}
+
+// Do runs fn after the burst of updates for key settled, replacing any
+// update still pending for it. Without a Debouncer, fn runs right away.
+func (d *Debouncer) Do(key string, fn func()) {
+	if d == nil {
+		fn()
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	p, ok := d.pending[key]
+	if !ok {
+		p = &pendingUpdate{first: now}
+		p.timer = time.AfterFunc(d.window, func() { d.fire(key, p) })
+		d.pending[key] = p
+	} else {
+		delay := d.window
+		if deadline := p.first.Add(d.maxDelay); d.maxDelay > 0 && now.Add(delay).After(deadline) {
+			delay = deadline.Sub(now)
+		}
+		p.timer.Reset(delay)
+	}
+	p.fn = fn
+}
+
+func (d *Debouncer) fire(key string, p *pendingUpdate) {
+	d.mu.Lock()
+	// Already ran, the timer was reset after it fired
+	if d.pending[key] != p {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, key)
+	fn := p.fn
+	d.mu.Unlock()
+
+	fn()
+}
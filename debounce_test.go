@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebouncerCoalescesBursts(t *testing.T) {
+	d := NewDebouncer(50*time.Millisecond, time.Second)
+	var runs, last int32
+	for i := int32(1); i <= 5; i++ {
+		i := i
+		d.Do("default/foo", func() {
+			atomic.AddInt32(&runs, 1)
+			atomic.StoreInt32(&last, i)
+		})
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("expected a single run, got %d", n)
+	}
+	if n := atomic.LoadInt32(&last); n != 5 {
+		t.Fatalf("expected the latest update to run, got %d", n)
+	}
+}
+
+func TestDebouncerMaxDelay(t *testing.T) {
+	d := NewDebouncer(50*time.Millisecond, 100*time.Millisecond)
+	var runs int32
+	// Never settles, but must not be delayed forever
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		d.Do("default/foo", func() { atomic.AddInt32(&runs, 1) })
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&runs); n < 2 {
+		t.Fatalf("expected updates to run every max delay, got %d runs", n)
+	}
+}
+
+func TestNilDebouncerRunsImmediately(t *testing.T) {
+	var d *Debouncer
+	ran := false
+	d.Do("default/foo", func() { ran = true })
+	if !ran {
+		t.Fatal("expected update to run right away")
+	}
+}
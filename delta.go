@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sort"
+	"strconv"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// deltaWatch is the state of a single resource type on an
+// incremental xDS stream.
+type deltaWatch struct {
+	// Wildcard watches get every resource assigned to the node,
+	// otherwise only the subscribed names.
+	wildcard bool
+	names    map[string]struct{}
+	// Version of every resource as last sent to Envoy
+	sent map[string]string
+	// Combined version of sent, for the node status
+	version string
+	nonce   string
+}
+
+type deltaStream struct {
+	stream  discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer
+	node    *core.Node
+	watches map[string]*deltaWatch
+	nonce   uint64
+}
+
+// Only listeners and clusters may be requested without naming them.
+func isWildcardType(typeURL string) bool {
+	switch typeURL {
+	case resource.ListenerType, resource.ClusterType,
+		resourcev3.ListenerType, resourcev3.ClusterType:
+		return true
+	}
+	return false
+}
+
+// DeltaAggregatedResources implements incremental xDS: Envoy only
+// receives resources that were added or changed since they were last
+// sent on the stream, and the names of the removed ones.
+func (s *adsServer) DeltaAggregatedResources(stream discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	st := &deltaStream{
+		stream:  stream,
+		watches: make(map[string]*deltaWatch),
+	}
+
+	reqs := make(chan *v2.DeltaDiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		configUpdates := s.controller.configStore.Updates()
+		epUpdates := s.controller.epStore.Updates()
+		secretUpdates := s.controller.secretStore.Updates()
+
+		var err error
+		select {
+		case req := <-reqs:
+			err = s.handleDeltaRequest(st, req)
+		case <-configUpdates:
+			err = s.pushAllDelta(st)
+		case <-epUpdates:
+			err = s.pushAllDelta(st)
+		case <-secretUpdates:
+			err = s.pushAllDelta(st)
+		case err = <-errs:
+			if err == io.EOF {
+				return nil
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *adsServer) handleDeltaRequest(st *deltaStream, req *v2.DeltaDiscoveryRequest) error {
+	if req.Node != nil {
+		st.node = req.Node
+	}
+	if st.node == nil {
+		return status.Error(codes.InvalidArgument, "missing node")
+	}
+
+	w, ok := st.watches[req.TypeUrl]
+	if !ok {
+		w = &deltaWatch{
+			wildcard: isWildcardType(req.TypeUrl) && len(req.ResourceNamesSubscribe) == 0,
+			names:    make(map[string]struct{}),
+			sent:     make(map[string]string),
+		}
+		// Envoy reconnecting tells us what it already has
+		for name, version := range req.InitialResourceVersions {
+			w.sent[name] = version
+		}
+		st.watches[req.TypeUrl] = w
+	}
+
+	if req.ResponseNonce != "" && req.ResponseNonce == w.nonce {
+		if req.ErrorDetail != nil {
+			log.Printf("delta ads: %s rejected %s: %s",
+				st.node.Id, req.TypeUrl, req.ErrorDetail.Message)
+			s.controller.nodeStore.Nack(st.node, req.TypeUrl, req.ErrorDetail.Message)
+		} else {
+			s.controller.nodeStore.Ack(st.node, req.TypeUrl, w.version)
+		}
+	}
+
+	for _, name := range req.ResourceNamesSubscribe {
+		w.names[name] = struct{}{}
+	}
+	for _, name := range req.ResourceNamesUnsubscribe {
+		delete(w.names, name)
+		delete(w.sent, name)
+	}
+
+	return s.pushDelta(st, req.TypeUrl, w)
+}
+
+func (s *adsServer) pushAllDelta(st *deltaStream) error {
+	for typeURL, w := range st.watches {
+		if err := s.pushDelta(st, typeURL, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushDelta sends the resources that changed since they were last
+// sent on the stream, if any.
+func (s *adsServer) pushDelta(st *deltaStream, typeURL string, w *deltaWatch) error {
+	names := make([]string, 0, len(w.names))
+	for name := range w.names {
+		names = append(names, name)
+	}
+
+	// Nothing, e.g. after the node's assignment was removed, is sent as
+	// the removal of everything sent before
+	resources, _ := s.controller.GetResources(typeURL, st.node, names)
+
+	changed := make([]*v2.Resource, 0)
+	for name, r := range resources {
+		if _, subscribed := w.names[name]; !w.wildcard && !subscribed {
+			continue
+		}
+		if version, ok := w.sent[name]; !ok || version != r.Version {
+			changed = append(changed, r)
+		}
+	}
+
+	removed := make([]string, 0)
+	for name := range w.sent {
+		if _, ok := resources[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+	sort.Strings(removed)
+
+	st.nonce++
+	resp := &v2.DeltaDiscoveryResponse{
+		Resources:        changed,
+		RemovedResources: removed,
+		TypeUrl:          typeURL,
+		Nonce:            strconv.FormatUint(st.nonce, 10),
+	}
+	if err := st.stream.Send(resp); err != nil {
+		return err
+	}
+
+	for _, r := range changed {
+		w.sent[r.Name] = r.Version
+	}
+	for _, name := range removed {
+		delete(w.sent, name)
+	}
+	versions := make([]string, 0, len(w.sent))
+	for name, version := range w.sent {
+		versions = append(versions, name+"="+version)
+	}
+	w.version = combineVersions(versions)
+	w.nonce = resp.Nonce
+	s.controller.nodeStore.Sent(st.node, typeURL, w.version)
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeDeltaStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	requests  chan *v2.DeltaDiscoveryRequest
+	responses chan *v2.DeltaDiscoveryResponse
+}
+
+func (s *fakeDeltaStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeDeltaStream) Send(resp *v2.DeltaDiscoveryResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+func (s *fakeDeltaStream) Recv() (*v2.DeltaDiscoveryRequest, error) {
+	select {
+	case req := <-s.requests:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeDeltaStream) expectResponse(t *testing.T) *v2.DeltaDiscoveryResponse {
+	t.Helper()
+	select {
+	case resp := <-s.responses:
+		return resp
+	case <-time.After(time.Second):
+		t.Fatal("expected a response")
+	}
+	return nil
+}
+
+func testEndpoints(name, version string, ips ...string) *v1.Endpoints {
+	addresses := make([]v1.EndpointAddress, len(ips))
+	for i, ip := range ips {
+		addresses[i] = v1.EndpointAddress{IP: ip}
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            name,
+			ResourceVersion: version,
+		},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: addresses,
+			Ports:     []v1.EndpointPort{{Port: 8080}},
+		}},
+	}
+}
+
+func TestDeltaEDS(t *testing.T) {
+	c := newTestController(t)
+	c.epStore.LoadEp(testEndpoints("foo", "1", "10.0.0.1"))
+	c.epStore.LoadEp(testEndpoints("bar", "1", "10.0.0.2"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeDeltaStream{
+		ctx:       ctx,
+		requests:  make(chan *v2.DeltaDiscoveryRequest, 10),
+		responses: make(chan *v2.DeltaDiscoveryResponse, 10),
+	}
+	go newADSServer(c).DeltaAggregatedResources(stream)
+
+	stream.requests <- &v2.DeltaDiscoveryRequest{
+		Node:                   &core.Node{Id: "a", Cluster: "foo"},
+		TypeUrl:                resource.EndpointType,
+		ResourceNamesSubscribe: []string{"default/foo", "default/bar"},
+	}
+	resp := stream.expectResponse(t)
+	if len(resp.Resources) != 2 {
+		t.Fatalf("expected both services, got %v", resp.Resources)
+	}
+
+	// Only the changed service is sent
+	foo, _ := c.epStore.Get("default/foo")
+	c.epStore.LoadEp(testEndpoints("foo", "2", "10.0.0.1", "10.0.0.3"))
+	resp = stream.expectResponse(t)
+	if len(resp.Resources) != 1 || resp.Resources[0].Name != "default/foo" || resp.Resources[0].Version == foo.version {
+		t.Fatalf("expected only default/foo, got %v", resp.Resources)
+	}
+
+	c.epStore.DeleteEp("default/bar")
+	resp = stream.expectResponse(t)
+	if len(resp.Resources) != 0 || len(resp.RemovedResources) != 1 || resp.RemovedResources[0] != "default/bar" {
+		t.Fatalf("expected default/bar to be removed, got %v", resp)
+	}
+}
+
+func TestDeltaRemovedAssignment(t *testing.T) {
+	c := newTestController(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeDeltaStream{
+		ctx:       ctx,
+		requests:  make(chan *v2.DeltaDiscoveryRequest, 10),
+		responses: make(chan *v2.DeltaDiscoveryResponse, 10),
+	}
+	go newADSServer(c).DeltaAggregatedResources(stream)
+
+	stream.requests <- &v2.DeltaDiscoveryRequest{
+		Node:    &core.Node{Id: "a", Cluster: "foo"},
+		TypeUrl: resource.ListenerType,
+	}
+	resp := stream.expectResponse(t)
+	if len(resp.Resources) != 1 {
+		t.Fatalf("expected listener foo, got %v", resp.Resources)
+	}
+
+	cm := testConfigMap("2", "foo")
+	cm.Data["assignments"] = "by-cluster: {}"
+	if err := c.configStore.Load(cm); err != nil {
+		t.Fatal(err)
+	}
+	resp = stream.expectResponse(t)
+	if len(resp.Resources) != 0 || len(resp.RemovedResources) != 1 || resp.RemovedResources[0] != "foo" {
+		t.Fatalf("expected foo to be removed, got %v", resp)
+	}
+}
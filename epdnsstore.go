@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// EDS service names starting with this are resolved through DNS, e.g.
+// `dns-srv:_redis._tcp.example.internal`
+const dnsSRVPrefix = "dns-srv:"
+
+const (
+	dnsRefreshInterval = 30 * time.Second
+	dnsTimeout         = 5 * time.Second
+)
+
+// srvResolver is implemented by *net.Resolver.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// EpDNSStore keeps the EpStore up to date from DNS SRV records, for
+// services managed outside of Kubernetes. Unlike STRICT_DNS clusters,
+// their endpoints show up in the control plane.
+type EpDNSStore struct {
+	resolver srvResolver
+
+	configStore *ConfigStore
+	epStore     *EpStore
+
+	// Set of service names resolved so far
+	names map[string]struct{}
+}
+
+func NewEpDNSStore(resolver srvResolver, configStore *ConfigStore, epStore *EpStore) *EpDNSStore {
+	return &EpDNSStore{
+		resolver:    resolver,
+		configStore: configStore,
+		epStore:     epStore,
+		names:       make(map[string]struct{}),
+	}
+}
+
+// Init resolves all services once. DNS failures don't keep xds from
+// starting, they are retried on the next refresh.
+func (ds *EpDNSStore) Init() error {
+	ds.Resolve()
+	return nil
+}
+
+func (ds *EpDNSStore) Run() {
+	ticker := time.NewTicker(dnsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ds.configStore.Updates():
+		}
+		ds.Resolve()
+	}
+}
+
+// Resolve looks up every configured service and removes those which
+// aren't configured anymore. Services that fail to resolve keep their
+// last endpoints.
+func (ds *EpDNSStore) Resolve() {
+	names := ds.configStore.GetConfigSnapshot().DNSServices()
+	for _, name := range names {
+		clas, err := ds.lookup(name)
+		if err != nil {
+			log.Printf("%s: %s", name, err)
+			continue
+		}
+		ds.names[name] = struct{}{}
+
+		version := contentVersion(clas[name])
+		if old, ok := ds.epStore.services.Load(name); ok && old.(*loadedService).version == version {
+			continue
+		}
+		ds.epStore.storeService(name, version, clas)
+	}
+	for name := range ds.names {
+		if !containsString(names, name) {
+			delete(ds.names, name)
+			ds.epStore.DeleteEp(name)
+		}
+	}
+}
+
+// lookup builds the ClusterLoadAssignment of a service from its SRV
+// records. Records of the lowest SRV priority get Envoy priority 0, the
+// next one 1 and so on, SRV weights become load balancing weights.
+func (ds *EpDNSStore) lookup(name string) (map[string]*v2.ClusterLoadAssignment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	_, srvs, err := ds.resolver.LookupSRV(ctx, "", "", strings.TrimPrefix(name, dnsSRVPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	priorities := make(map[uint16][]*endpoint.LbEndpoint)
+	for _, srv := range srvs {
+		addrs, err := ds.resolver.LookupIPAddr(ctx, srv.Target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", srv.Target, err)
+		}
+		for _, addr := range addrs {
+			lbEndpoint := newLbEndpoint(addr.IP.String(), int32(srv.Port))
+			lbEndpoint.HealthStatus = core.HealthStatus_HEALTHY
+			if srv.Weight > 0 {
+				lbEndpoint.LoadBalancingWeight = &wrappers.UInt32Value{Value: uint32(srv.Weight)}
+			}
+			priorities[srv.Priority] = append(priorities[srv.Priority], lbEndpoint)
+		}
+	}
+	if len(priorities) == 0 {
+		return assignmentsByPort(name, nil), nil
+	}
+
+	order := make([]int, 0, len(priorities))
+	for p := range priorities {
+		order = append(order, int(p))
+	}
+	sort.Ints(order)
+	localities := make([]*endpoint.LocalityLbEndpoints, len(order))
+	for i, p := range order {
+		lbEndpoints := priorities[uint16(p)]
+		// Resolvers shuffle records, which must not change the version
+		sort.Slice(lbEndpoints, func(i, j int) bool {
+			a := lbEndpoints[i].GetEndpoint().GetAddress().GetSocketAddress()
+			b := lbEndpoints[j].GetEndpoint().GetAddress().GetSocketAddress()
+			if a.GetAddress() != b.GetAddress() {
+				return a.GetAddress() < b.GetAddress()
+			}
+			return a.GetPortValue() < b.GetPortValue()
+		})
+		localities[i] = &endpoint.LocalityLbEndpoints{
+			LbEndpoints: lbEndpoints,
+			Priority:    uint32(i),
+		}
+	}
+	return map[string]*v2.ClusterLoadAssignment{
+		name: {
+			ClusterName: name,
+			Endpoints:   localities,
+		},
+	}, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/ptypes"
+)
+
+type stubResolver struct {
+	srvs map[string][]*net.SRV
+	ips  map[string][]net.IPAddr
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	srvs, ok := r.srvs[name]
+	if !ok {
+		return "", nil, errors.New("no such host")
+	}
+	return name, srvs, nil
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+func TestDNSSRVEndpoints(t *testing.T) {
+	const name = "dns-srv:_redis._tcp.example.internal"
+	c := newTestController(t)
+	if err := c.configStore.Load(testEDSConfigMap(name)); err != nil {
+		t.Fatal(err)
+	}
+	if c.GetConfigSnapshot().HasService(name) {
+		t.Fatal("dns-srv services must not be watched in Kubernetes")
+	}
+
+	resolver := &stubResolver{
+		srvs: map[string][]*net.SRV{
+			"_redis._tcp.example.internal": {
+				{Target: "c.example.internal.", Port: 6380, Priority: 20},
+				{Target: "a.example.internal.", Port: 6379, Priority: 10, Weight: 3},
+				{Target: "b.example.internal.", Port: 6379, Priority: 10, Weight: 1},
+			},
+		},
+		ips: map[string][]net.IPAddr{
+			"a.example.internal.": {{IP: net.ParseIP("10.0.0.1")}},
+			"b.example.internal.": {{IP: net.ParseIP("10.0.0.2")}},
+			"c.example.internal.": {{IP: net.ParseIP("10.0.0.3")}},
+		},
+	}
+	ds := NewEpDNSStore(resolver, c.configStore, c.epStore)
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ep, ok := c.epStore.Get(name)
+	if !ok {
+		t.Fatalf("missing %s", name)
+	}
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(ep.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	if len(cla.Endpoints) != 2 || cla.Endpoints[1].Priority != 1 {
+		t.Fatalf("expected one priority per SRV priority: %v", &cla)
+	}
+	primary := cla.Endpoints[0].LbEndpoints
+	if len(primary) != 2 || primary[0].GetLoadBalancingWeight().GetValue() != 3 {
+		t.Fatalf("expected SRV weights to be kept: %v", &cla)
+	}
+	if port := cla.Endpoints[1].LbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress().GetPortValue(); port != 6380 {
+		t.Fatalf("expected SRV port, got %d", port)
+	}
+
+	// Failed lookups keep the last endpoints
+	delete(resolver.ips, "c.example.internal.")
+	ds.Resolve()
+	if ep2, _ := c.epStore.Get(name); ep2 != ep {
+		t.Fatal("expected endpoints to be unchanged")
+	}
+
+	// Services no longer configured go away
+	if err := c.configStore.Load(testEDSConfigMap("default/foo")); err != nil {
+		t.Fatal(err)
+	}
+	ds.Resolve()
+	if _, ok := c.epStore.Get(name); ok {
+		t.Fatalf("expected %s to be removed", name)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"sigs.k8s.io/yaml"
+)
+
+// How often the endpoints file is checked for changes
+const endpointsFileInterval = 5 * time.Second
+
+// Prefix of EDS service names served from the endpoints file, keeping
+// them apart from Kubernetes services of the same name
+const fileServicePrefix = "file:"
+
+// fileEndpoint is an address of a service that doesn't run in
+// Kubernetes, e.g. a managed database or a VM.
+type fileEndpoint struct {
+	Address string            `json:"address"`
+	Port    int32             `json:"port"`
+	Region  string            `json:"region,omitempty"`
+	Zone    string            `json:"zone,omitempty"`
+	Weight  uint32            `json:"weight,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// EpFileStore keeps the EpStore up to date from a YAML or JSON file
+// mapping service names to their addresses, alongside Kubernetes:
+//
+//	external/postgres:
+//	- address: 10.0.0.1
+//	  port: 5432
+//	  zone: us-east1-b
+//
+// Clusters refer to them as `file:external/postgres`. The file is
+// reloaded when it changes, e.g. when the ConfigMap it is mounted from
+// is updated.
+type EpFileStore struct {
+	path    string
+	epStore *EpStore
+
+	// Contents of the file as last loaded
+	data []byte
+	// Service name -> endpoints as last loaded
+	services map[string][]fileEndpoint
+}
+
+func NewEpFileStore(path string, epStore *EpStore) *EpFileStore {
+	return &EpFileStore{
+		path:    path,
+		epStore: epStore,
+	}
+}
+
+func (fs *EpFileStore) Init() error {
+	return fs.Load()
+}
+
+func (fs *EpFileStore) Run() {
+	for range time.Tick(endpointsFileInterval) {
+		if err := fs.Load(); err != nil {
+			log.Printf("%s: %s", fs.path, err)
+		}
+	}
+}
+
+// Load reads the file and stores the services that changed since it
+// was last loaded. An invalid file is rejected as a whole, the services
+// loaded before keep being served.
+func (fs *EpFileStore) Load() error {
+	data, err := ioutil.ReadFile(fs.path)
+	if err != nil {
+		return err
+	}
+	if fs.data != nil && bytes.Equal(data, fs.data) {
+		return nil
+	}
+
+	var services map[string][]fileEndpoint
+	if err := yaml.UnmarshalStrict(data, &services); err != nil {
+		return err
+	}
+	for name, eps := range services {
+		for _, ep := range eps {
+			if net.ParseIP(ep.Address) == nil {
+				return fmt.Errorf("%s: invalid address: %q", name, ep.Address)
+			}
+			if ep.Port <= 0 || ep.Port > 65535 {
+				return fmt.Errorf("%s: invalid port: %d", name, ep.Port)
+			}
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write(data)
+	version := fmt.Sprintf("%x", h.Sum64())
+
+	for name, eps := range services {
+		if old, ok := fs.services[name]; ok && reflect.DeepEqual(old, eps) {
+			continue
+		}
+		name = fileServicePrefix + name
+		fs.epStore.storeService(name, version, fileAssignments(name, eps))
+	}
+	for name := range fs.services {
+		if _, ok := services[name]; !ok {
+			fs.epStore.DeleteEp(fileServicePrefix + name)
+		}
+	}
+	fs.data = data
+	fs.services = services
+	return nil
+}
+
+// fileAssignments groups the endpoints of a service by locality.
+func fileAssignments(name string, eps []fileEndpoint) map[string]*v2.ClusterLoadAssignment {
+	localities := make(map[locality][]*endpoint.LbEndpoint)
+	for _, ep := range eps {
+		l := locality{region: ep.Region, zone: ep.Zone}
+		lbEndpoint := newLbEndpoint(ep.Address, ep.Port)
+		lbEndpoint.HealthStatus = core.HealthStatus_HEALTHY
+		(&podMetadata{weight: ep.Weight, labels: ep.Labels}).apply(lbEndpoint)
+		localities[l] = append(localities[l], lbEndpoint)
+	}
+
+	ports := make(map[string][]*endpoint.LocalityLbEndpoints)
+	if len(localities) > 0 {
+		ports[""] = localityLbEndpoints(localities)
+	}
+	return assignmentsByPort(name, ports)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/ptypes"
+)
+
+func TestEndpointsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "endpoints.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestController(t)
+	fs := NewEpFileStore(path, c.epStore)
+	write(`
+external/postgres:
+- address: 10.0.0.1
+  port: 5432
+  zone: us-east1-b
+  weight: 2
+- address: 10.0.0.2
+  port: 5432
+  zone: us-east1-c
+external/redis:
+- address: 10.0.1.1
+  port: 6379
+`)
+	if err := fs.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ep, ok := c.epStore.Get("file:external/postgres")
+	if !ok {
+		t.Fatal("missing external/postgres")
+	}
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(ep.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	if len(cla.Endpoints) != 2 || cla.Endpoints[0].GetLocality().GetZone() != "us-east1-b" {
+		t.Fatalf("expected one locality per zone: %v", &cla)
+	}
+	if w := cla.Endpoints[0].LbEndpoints[0].GetLoadBalancingWeight().GetValue(); w != 2 {
+		t.Fatalf("expected weight 2, got %d", w)
+	}
+	redis, _ := c.epStore.Get("file:external/redis")
+
+	// Invalid files are rejected as a whole
+	write(`
+external/postgres:
+- address: db.example.com
+  port: 5432
+`)
+	if err := fs.Load(); err == nil {
+		t.Fatal("expected hostnames to be rejected")
+	}
+	if ep2, _ := c.epStore.Get("file:external/postgres"); ep2.version != ep.version {
+		t.Fatal("expected external/postgres to be unchanged")
+	}
+
+	write(`{"external/redis": [{"address": "10.0.1.1", "port": 6379}]}`)
+	if err := fs.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.epStore.Get("file:external/postgres"); ok {
+		t.Fatal("expected external/postgres to be removed")
+	}
+	if ep2, _ := c.epStore.Get("file:external/redis"); ep2 != redis {
+		t.Fatal("expected unchanged external/redis not to be reloaded")
+	}
+}
+
+func TestEndpointsFileNamedLikeService(t *testing.T) {
+	f, err := ioutil.TempFile("", "xds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"default/foo": [{"address": "10.0.1.1", "port": 8080}]}`)
+	f.Close()
+
+	c := newTestController(t)
+	c.epStore.LoadEp(testEndpoints("foo", "1", "10.0.0.1"))
+	ep, _ := c.epStore.Get("default/foo")
+	if err := NewEpFileStore(f.Name(), c.epStore).Init(); err != nil {
+		t.Fatal(err)
+	}
+	if ep2, ok := c.epStore.Get("default/foo"); !ok || ep2 != ep {
+		t.Fatal("expected Kubernetes service default/foo to be kept")
+	}
+	if _, ok := c.epStore.Get("file:default/foo"); !ok {
+		t.Fatal("missing file:default/foo")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+// EpGuard protects against services losing all, or most, of their
+// endpoints at once, as happens with bad deploys or when the API server
+// has a hiccup. Such updates are held back for a grace period, during
+// which the last assignment keeps being served. If the endpoints come
+// back in the meantime, the update is never seen by Envoy.
+type EpGuard struct {
+	gracePeriod time.Duration
+	// Largest share of healthy endpoints in percent that may go away in
+	// a single update, zero only guards against losing all of them.
+	maxDrop int
+
+	// Service key -> held back update, guarded by the EpStore
+	held map[string]*heldUpdate
+}
+
+type heldUpdate struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+
+	// Carries out the latest update, once the grace period is over
+	apply func()
+}
+
+func NewEpGuard(gracePeriod time.Duration, maxDrop int) *EpGuard {
+	return &EpGuard{
+		gracePeriod: gracePeriod,
+		maxDrop:     maxDrop,
+		held:        make(map[string]*heldUpdate),
+	}
+}
+
+// check returns why an update from the healthy endpoints in before to
+// those in after, keyed by cluster name, must be held back, if it must.
+func (g *EpGuard) check(before, after map[string]int) string {
+	for name, n := range before {
+		if n == 0 {
+			continue
+		}
+		m := after[name]
+		if m == 0 {
+			return fmt.Sprintf("%s has no healthy endpoints left", name)
+		}
+		if drop := (n - m) * 100 / n; g.maxDrop > 0 && drop > g.maxDrop {
+			return fmt.Sprintf("%s lost %d%% of its healthy endpoints", name, drop)
+		}
+	}
+	return ""
+}
+
+func countHealthy(cla *v2.ClusterLoadAssignment) int {
+	n := 0
+	for _, localities := range cla.Endpoints {
+		for _, lbEndpoint := range localities.LbEndpoints {
+			switch lbEndpoint.HealthStatus {
+			case core.HealthStatus_UNKNOWN, core.HealthStatus_HEALTHY:
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// healthy returns the number of healthy endpoints currently served for
+// each cluster name of a service.
+func (es *EpStore) healthy(key string) map[string]int {
+	rv := make(map[string]int)
+	if loaded, ok := es.services.Load(key); ok {
+		for _, name := range loaded.(*loadedService).names {
+			if ep, ok := es.Get(name); ok {
+				rv[name] = ep.healthy
+			}
+		}
+	}
+	return rv
+}
+
+// guarded carries out an update of a service leaving it with the given
+// healthy endpoints, or holds it back. The caller must hold es.mu.
+func (es *EpStore) guarded(key string, after map[string]int, apply func()) {
+	if es.guard == nil {
+		apply()
+		return
+	}
+
+	h, held := es.guard.held[key]
+	reason := es.guard.check(es.healthy(key), after)
+	if reason == "" {
+		if held {
+			log.Printf("%s: releasing held back endpoints", key)
+			delete(es.guard.held, key)
+		}
+		apply()
+		return
+	}
+
+	// Only the latest update is applied after the grace period
+	if held {
+		h.Reason = reason
+		h.apply = apply
+		return
+	}
+
+	log.Printf("%s: holding back endpoints for %s: %s", key, es.guard.gracePeriod, reason)
+	now := time.Now()
+	h = &heldUpdate{
+		Since:  now,
+		Until:  now.Add(es.guard.gracePeriod),
+		Reason: reason,
+		apply:  apply,
+	}
+	es.guard.held[key] = h
+	time.AfterFunc(es.guard.gracePeriod, func() {
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		// Released or held again in the meantime
+		if es.guard.held[key] != h {
+			return
+		}
+		log.Printf("%s: grace period is over, applying endpoints: %s", key, h.Reason)
+		delete(es.guard.held, key)
+		h.apply()
+	})
+}
+
+// Held returns the updates currently held back by service key.
+func (es *EpStore) Held() map[string]heldUpdate {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	rv := make(map[string]heldUpdate)
+	if es.guard == nil {
+		return rv
+	}
+	for key, h := range es.guard.held {
+		rv[key] = *h
+	}
+	return rv
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEpGuardHoldsBackDrops(t *testing.T) {
+	es := &EpStore{guard: NewEpGuard(100*time.Millisecond, 50), updates: newNotifier()}
+	expectHealthy := func(n int) {
+		t.Helper()
+		ep, ok := es.Get("default/foo")
+		if !ok || ep.healthy != n {
+			t.Fatalf("expected %d healthy endpoints, got %v", n, ep)
+		}
+	}
+
+	es.LoadEp(testEndpoints("foo", "1", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"))
+	expectHealthy(4)
+
+	es.LoadEp(testEndpoints("foo", "2"))
+	expectHealthy(4)
+	if _, ok := es.Held()["default/foo"]; !ok {
+		t.Fatal("expected default/foo to be held back")
+	}
+
+	// Still too much of a drop
+	es.LoadEp(testEndpoints("foo", "3", "10.0.0.1"))
+	expectHealthy(4)
+
+	es.LoadEp(testEndpoints("foo", "4", "10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	expectHealthy(3)
+	if len(es.Held()) != 0 {
+		t.Fatalf("expected nothing to be held back, got %v", es.Held())
+	}
+
+	// Deletion goes through once the grace period is over
+	es.DeleteEp("default/foo")
+	expectHealthy(3)
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := es.Get("default/foo"); ok {
+		t.Fatal("expected default/foo to be removed after the grace period")
+	}
+}
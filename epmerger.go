@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/golang/protobuf/proto"
+)
+
+// EpMerger merges the endpoints of services spanning several Kubernetes
+// clusters. Every cluster gets its own priorities, in the order the
+// clusters were given, so that Envoy fails over to the next cluster
+// once the endpoints of a service in the previous ones are unhealthy.
+type EpMerger struct {
+	epStore *EpStore
+
+	mu sync.Mutex
+	// Endpoints key -> Kubernetes cluster -> ClusterLoadAssignments
+	services map[string]clusterServices
+}
+
+type clusterService struct {
+	version string
+	clas    map[string]*v2.ClusterLoadAssignment
+}
+
+func NewEpMerger(epStore *EpStore) *EpMerger {
+	return &EpMerger{
+		epStore:  epStore,
+		services: make(map[string]clusterServices),
+	}
+}
+
+// storeService replaces the ClusterLoadAssignments of a service in
+// the given cluster.
+func (m *EpMerger) storeService(cluster int, epKey string, version string, clas map[string]*v2.ClusterLoadAssignment) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clusters, ok := m.services[epKey]
+	if !ok {
+		clusters = make(clusterServices)
+		m.services[epKey] = clusters
+	}
+	clusters[cluster] = &clusterService{version: version, clas: clas}
+	m.epStore.storeService(epKey, clusters.version(), clusters.merge())
+}
+
+// deleteService removes a service from the given cluster, and from the
+// EpStore once no cluster has it anymore.
+func (m *EpMerger) deleteService(cluster int, epKey string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clusters, ok := m.services[epKey]
+	if !ok {
+		return
+	}
+	delete(clusters, cluster)
+	if len(clusters) == 0 {
+		delete(m.services, epKey)
+		m.epStore.DeleteEp(epKey)
+		return
+	}
+	m.epStore.storeService(epKey, clusters.version(), clusters.merge())
+}
+
+type clusterServices map[int]*clusterService
+
+func (cs clusterServices) order() []int {
+	order := make([]int, 0, len(cs))
+	for cluster := range cs {
+		order = append(order, cluster)
+	}
+	sort.Ints(order)
+	return order
+}
+
+func (cs clusterServices) version() string {
+	versions := make([]string, 0, len(cs))
+	for cluster, s := range cs {
+		versions = append(versions, fmt.Sprintf("%d=%s", cluster, s.version))
+	}
+	return combineVersions(versions)
+}
+
+// merge builds the ClusterLoadAssignments of all clusters. The
+// priorities of each cluster come after those of the previous ones,
+// clusters without any endpoints are skipped.
+func (cs clusterServices) merge() map[string]*v2.ClusterLoadAssignment {
+	names := make(map[string]struct{})
+	for _, s := range cs {
+		for name := range s.clas {
+			names[name] = struct{}{}
+		}
+	}
+
+	clas := make(map[string]*v2.ClusterLoadAssignment, len(names))
+	for name := range names {
+		var localities []*endpoint.LocalityLbEndpoints
+		base := uint32(0)
+		for _, cluster := range cs.order() {
+			cla, ok := cs[cluster].clas[name]
+			if !ok || !hasEndpoints(cla) {
+				continue
+			}
+			next := base
+			for _, l := range cla.Endpoints {
+				l = proto.Clone(l).(*endpoint.LocalityLbEndpoints)
+				l.Priority += base
+				if l.Priority >= next {
+					next = l.Priority + 1
+				}
+				localities = append(localities, l)
+			}
+			base = next
+		}
+		if len(localities) == 0 {
+			// Services without any ready endpoint still exist
+			localities = []*endpoint.LocalityLbEndpoints{{
+				LbEndpoints: []*endpoint.LbEndpoint{},
+			}}
+		}
+		clas[name] = &v2.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints:   localities,
+		}
+	}
+	return clas
+}
+
+func hasEndpoints(cla *v2.ClusterLoadAssignment) bool {
+	for _, l := range cla.Endpoints {
+		if len(l.LbEndpoints) > 0 {
+			return true
+		}
+	}
+	return false
+}
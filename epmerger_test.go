@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/ptypes"
+)
+
+func TestEndpointsMergedAcrossClusters(t *testing.T) {
+	es := &EpStore{updates: newNotifier()}
+	es.merger = NewEpMerger(es)
+	remote := &EpStore{cluster: 1, merger: es.merger}
+	expectPriorities := func(priorities ...uint32) {
+		t.Helper()
+		ep, ok := es.Get("default/foo")
+		if !ok {
+			t.Fatal("missing default/foo")
+		}
+		var cla v2.ClusterLoadAssignment
+		if err := ptypes.UnmarshalAny(ep.resource, &cla); err != nil {
+			t.Fatal(err)
+		}
+		if len(cla.Endpoints) != len(priorities) {
+			t.Fatalf("expected %d localities: %v", len(priorities), &cla)
+		}
+		for i, p := range priorities {
+			if cla.Endpoints[i].Priority != p {
+				t.Fatalf("expected priorities %v: %v", priorities, &cla)
+			}
+		}
+	}
+
+	es.LoadEp(testEndpoints("foo", "1", "10.0.0.1"))
+	remote.LoadEp(testEndpoints("foo", "7", "10.1.0.1", "10.1.0.2"))
+	expectPriorities(0, 1)
+
+	// The remote cluster takes over
+	es.LoadEp(testEndpoints("foo", "2"))
+	expectPriorities(0)
+
+	es.deleteK8sService("default/foo")
+	expectPriorities(0)
+	remote.deleteK8sService("default/foo")
+	if _, ok := es.Get("default/foo"); ok {
+		t.Fatal("expected default/foo to be removed")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+const serviceNameLabel = "kubernetes.io/service-name"
+
+// EndpointSlice API versions, in order of preference. v1beta1 is only
+// served up to Kubernetes 1.24, v1 from 1.21 on.
+var endpointSliceResources = []schema.GroupVersionResource{
+	{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"},
+	{Group: "discovery.k8s.io", Version: "v1beta1", Resource: "endpointslices"},
+}
+
+// The bits of discovery.k8s.io EndpointSlices we need, either v1 or
+// v1beta1. The vendored client-go predates them so they are read
+// through the dynamic client.
+type endpointSlice struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	AddressType string               `json:"addressType"`
+	Endpoints   []endpointSliceEntry `json:"endpoints"`
+	Ports       []endpointSlicePort  `json:"ports"`
+}
+
+type endpointSliceEntry struct {
+	Addresses  []string          `json:"addresses"`
+	Conditions endpointCondition `json:"conditions"`
+	// v1 only
+	Zone *string `json:"zone,omitempty"`
+	// v1beta1 only
+	Topology  map[string]string   `json:"topology,omitempty"`
+	NodeName  *string             `json:"nodeName,omitempty"`
+	TargetRef *v1.ObjectReference `json:"targetRef,omitempty"`
+}
+
+type endpointCondition struct {
+	Ready *bool `json:"ready,omitempty"`
+}
+
+type endpointSlicePort struct {
+	Name *string `json:"name,omitempty"`
+	Port *int32  `json:"port,omitempty"`
+}
+
+// EpSliceStore keeps the EpStore up to date from EndpointSlices instead
+// of Endpoints. These aren't truncated for large services and only the
+// slice that changed is sent on updates. All slices of a service are
+// merged into the same ClusterLoadAssignments, with one locality per zone.
+type EpSliceStore struct {
+	client dynamic.Interface
+	// API version served by the cluster, picked by Init
+	resource schema.GroupVersionResource
+
+	informer cache.SharedIndexInformer
+	store    cache.Store
+
+	configStore *ConfigStore
+	epStore     *EpStore
+
+	mu sync.Mutex
+	// Service key -> slice name -> slice
+	slices map[string]map[string]*endpointSlice
+}
+
+func NewEpSliceStore(
+	client dynamic.Interface,
+	configStore *ConfigStore,
+	epStore *EpStore,
+) *EpSliceStore {
+	ss := &EpSliceStore{
+		client:      client,
+		resource:    endpointSliceResources[0],
+		configStore: configStore,
+		epStore:     epStore,
+		slices:      make(map[string]map[string]*endpointSlice),
+	}
+
+	ss.informer = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return ss.client.Resource(ss.resource).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return ss.client.Resource(ss.resource).Watch(options)
+			},
+		},
+		&unstructured.Unstructured{},
+		0,
+		cache.Indexers{},
+	)
+	ss.store = ss.informer.GetStore()
+	ss.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ss.handleSlice(obj, ss.setSlice)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			ss.handleSlice(cur, ss.setSlice)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = d.Obj
+			}
+			ss.handleSlice(obj, ss.removeSlice)
+		},
+	})
+	return ss
+}
+
+// Init lists the EndpointSlices of the first API version the cluster
+// serves.
+func (ss *EpSliceStore) Init() error {
+	var slices *unstructured.UnstructuredList
+	var err error
+	for _, resource := range endpointSliceResources {
+		ss.resource = resource
+		slices, err = ss.client.Resource(resource).List(metav1.ListOptions{})
+		if !apierrors.IsNotFound(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("watching EndpointSlices of %s", ss.resource.GroupVersion())
+	for i := range slices.Items {
+		ss.store.Add(&slices.Items[i])
+		slice, err := toEndpointSlice(&slices.Items[i])
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		ss.LoadSlice(slice)
+	}
+	return nil
+}
+
+func (ss *EpSliceStore) Run() {
+	go ss.informer.Run(nil)
+	go ss.epStore.watchPods(ss.podServices, ss.syncService)
+
+	// Rebuild all services on changes to what's looked up beyond the
+	// slices: node localities and cluster settings.
+	notReadyHealth := ss.configStore.GetConfigSnapshot().notReadyHealth
+	for {
+		if !ss.epStore.waitForRegroup(&notReadyHealth) {
+			continue
+		}
+		ss.mu.Lock()
+		for key, slices := range ss.slices {
+			ss.loadService(key, slices)
+		}
+		ss.mu.Unlock()
+	}
+}
+
+func toEndpointSlice(obj interface{}) (*endpointSlice, error) {
+	var slice endpointSlice
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(
+		obj.(*unstructured.Unstructured).UnstructuredContent(), &slice)
+	return &slice, err
+}
+
+// handleSlice applies an informer event through update, bursts of
+// changes to a service are coalesced before they are loaded.
+func (ss *EpSliceStore) handleSlice(obj interface{}, update func(*endpointSlice) (string, bool)) {
+	slice, err := toEndpointSlice(obj)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if key, ok := update(slice); ok {
+		ss.epStore.debounce.Do(key, func() { ss.syncService(key) })
+	}
+}
+
+// sliceService returns the key of the service a slice belongs to, as
+// used by the configmap.
+func sliceService(slice *endpointSlice) (string, bool) {
+	name, ok := slice.Labels[serviceNameLabel]
+	if !ok {
+		return "", false
+	}
+	return slice.Namespace + "/" + name, true
+}
+
+func (ss *EpSliceStore) LoadSlice(slice *endpointSlice) {
+	if key, ok := ss.setSlice(slice); ok {
+		ss.syncService(key)
+	}
+}
+
+func (ss *EpSliceStore) DeleteSlice(slice *endpointSlice) {
+	if key, ok := ss.removeSlice(slice); ok {
+		ss.syncService(key)
+	}
+}
+
+// setSlice adds or replaces a slice, returning the key of its service
+// and whether anything changed.
+func (ss *EpSliceStore) setSlice(slice *endpointSlice) (string, bool) {
+	key, ok := sliceService(slice)
+	if !ok || !ss.configStore.GetConfigSnapshot().HasService(key) {
+		return "", false
+	}
+	// Only IP addresses can be used by Envoy
+	if slice.AddressType == "FQDN" {
+		return "", false
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	slices, ok := ss.slices[key]
+	if !ok {
+		slices = make(map[string]*endpointSlice)
+		ss.slices[key] = slices
+	}
+	if old, ok := slices[slice.Name]; ok && old.ResourceVersion == slice.ResourceVersion {
+		return "", false
+	}
+	slices[slice.Name] = slice
+	return key, true
+}
+
+func (ss *EpSliceStore) removeSlice(slice *endpointSlice) (string, bool) {
+	key, ok := sliceService(slice)
+	if !ok {
+		return "", false
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	slices, ok := ss.slices[key]
+	if !ok {
+		return "", false
+	}
+	delete(slices, slice.Name)
+	return key, true
+}
+
+// podServices returns the keys of the services with endpoints on any of
+// pods.
+func (ss *EpSliceStore) podServices(pods []string) []string {
+	changed := make(map[string]struct{}, len(pods))
+	for _, pod := range pods {
+		changed[pod] = struct{}{}
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var keys []string
+	for key, slices := range ss.slices {
+		if slicesUsePods(slices, changed) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func slicesUsePods(slices map[string]*endpointSlice, pods map[string]struct{}) bool {
+	for _, slice := range slices {
+		for _, ep := range slice.Endpoints {
+			if ref := ep.TargetRef; ref != nil && ref.Kind == "Pod" {
+				if _, ok := pods[ref.Namespace+"/"+ref.Name]; ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// syncService loads the current slices of a service into the EpStore.
+func (ss *EpSliceStore) syncService(key string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	slices := ss.slices[key]
+	if len(slices) == 0 {
+		delete(ss.slices, key)
+		ss.epStore.deleteK8sService(key)
+		return
+	}
+	ss.loadService(key, slices)
+}
+
+// loadService merges all slices of a service into the EpStore.
+func (ss *EpSliceStore) loadService(key string, slices map[string]*endpointSlice) {
+	versions := make([]string, 0, len(slices))
+	for name, slice := range slices {
+		versions = append(versions, name+"="+slice.ResourceVersion)
+	}
+	ss.epStore.storeK8sService(key, combineVersions(versions), ss.sliceAssignments(key, slices))
+}
+
+// sliceAssignments groups the endpoints of a service by port and zone,
+// keyed by cluster name.
+func (ss *EpSliceStore) sliceAssignments(key string, slices map[string]*endpointSlice) map[string]*v2.ClusterLoadAssignment {
+	topology := ss.epStore.topology
+	// Port name -> locality -> endpoints
+	ports := make(map[string]map[locality][]*endpoint.LbEndpoint)
+
+	// Walk slices in a stable order, so that the content
+	// only changes with the endpoints.
+	names := make([]string, 0, len(slices))
+	for name := range slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		slice := slices[name]
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			portName := ""
+			if port.Name != nil {
+				portName = *port.Name
+			}
+			localities, ok := ports[portName]
+			if !ok {
+				localities = make(map[locality][]*endpoint.LbEndpoint)
+				ports[portName] = localities
+			}
+			for _, ep := range slice.Endpoints {
+				l := ep.locality()
+				if l.region == "" {
+					var node locality
+					if ep.NodeName != nil {
+						node = topology.Get(*ep.NodeName)
+					} else {
+						node = topology.Get(ep.Topology[hostnameLabel])
+					}
+					// v1 slices only carry the zone
+					if l.zone == "" {
+						l = node
+					} else if node.zone == l.zone {
+						l.region = node.region
+					}
+				}
+				for _, address := range ep.Addresses {
+					lbEndpoint := newLbEndpoint(address, *port.Port)
+					lbEndpoint.HealthStatus = conditionHealth(ep.Conditions)
+					ss.epStore.pods.Get(ep.TargetRef).apply(lbEndpoint)
+					localities[l] = append(localities[l], lbEndpoint)
+				}
+			}
+		}
+	}
+
+	byPort := make(map[string][]*endpoint.LocalityLbEndpoints, len(ports))
+	for port, localities := range ports {
+		byPort[port] = localityLbEndpoints(localities)
+	}
+	return assignmentsByPort(key, byPort)
+}
+
+// locality returns the locality an endpoint was given by the
+// EndpointSlice controller, from its zone in v1 and from its topology
+// in v1beta1.
+func (ep *endpointSliceEntry) locality() locality {
+	l := topologyLocality(ep.Topology)
+	if ep.Zone != nil && *ep.Zone != "" {
+		l.zone = *ep.Zone
+	}
+	return l
+}
+
+// conditionHealth maps the conditions of an endpoint onto its health,
+// a missing condition means ready.
+func conditionHealth(conditions endpointCondition) core.HealthStatus {
+	if conditions.Ready != nil && !*conditions.Ready {
+		return defaultNotReadyHealth
+	}
+	return core.HealthStatus_HEALTHY
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/golang/protobuf/ptypes"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// fakeSliceClient serves the EndpointSlices of the API versions it has
+// any for, like a cluster serving only these.
+type fakeSliceClient struct {
+	dynamic.Interface
+	slices map[string][]unstructured.Unstructured
+}
+
+func (c *fakeSliceClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &fakeSliceResource{slices: c.slices[resource.Version], served: c.slices[resource.Version] != nil, resource: resource}
+}
+
+type fakeSliceResource struct {
+	dynamic.NamespaceableResourceInterface
+	resource schema.GroupVersionResource
+	served   bool
+	slices   []unstructured.Unstructured
+}
+
+func (r *fakeSliceResource) List(metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	if !r.served {
+		return nil, apierrors.NewNotFound(r.resource.GroupResource(), "")
+	}
+	return &unstructured.UnstructuredList{Items: r.slices}, nil
+}
+
+func testSlice(name, version string, entries ...endpointSliceEntry) *endpointSlice {
+	port := int32(8080)
+	return &endpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            name,
+			ResourceVersion: version,
+			Labels:          map[string]string{serviceNameLabel: "foo"},
+		},
+		AddressType: "IPv4",
+		Endpoints:   entries,
+		Ports:       []endpointSlicePort{{Port: &port}},
+	}
+}
+
+func TestEndpointSlicesMerged(t *testing.T) {
+	c := newTestController(t)
+	if err := c.configStore.Load(testEDSConfigMap("default/foo")); err != nil {
+		t.Fatal(err)
+	}
+	ss := &EpSliceStore{
+		configStore: c.configStore,
+		epStore:     c.epStore,
+		slices:      make(map[string]map[string]*endpointSlice),
+	}
+
+	notReady := false
+	ss.LoadSlice(testSlice("foo-a", "1", endpointSliceEntry{
+		Addresses: []string{"10.0.0.1"},
+		Topology:  map[string]string{zoneLabel: "us-east1-b"},
+	}))
+	ss.LoadSlice(testSlice("foo-b", "1", endpointSliceEntry{
+		Addresses:  []string{"10.0.0.2"},
+		Conditions: endpointCondition{Ready: &notReady},
+		Topology:   map[string]string{zoneLabel: "us-east1-c"},
+	}))
+
+	ep, ok := c.epStore.Get("default/foo")
+	if !ok {
+		t.Fatal("missing default/foo")
+	}
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(ep.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	if len(cla.Endpoints) != 2 {
+		t.Fatalf("expected one locality per zone: %v", &cla)
+	}
+	b := cla.Endpoints[0]
+	if b.Locality.Zone != "us-east1-b" || b.LbEndpoints[0].HealthStatus != core.HealthStatus_HEALTHY {
+		t.Fatalf("unexpected locality: %v", b)
+	}
+	if c := cla.Endpoints[1]; c.Locality.Zone != "us-east1-c" || c.LbEndpoints[0].HealthStatus != core.HealthStatus_DRAINING {
+		t.Fatalf("unexpected locality: %v", c)
+	}
+
+	ss.DeleteSlice(testSlice("foo-b", "1"))
+	ep, _ = c.epStore.Get("default/foo")
+	ptypes.UnmarshalAny(ep.resource, &cla)
+	if len(cla.Endpoints) != 1 {
+		t.Fatalf("expected foo-b to be removed: %v", &cla)
+	}
+
+	ss.DeleteSlice(testSlice("foo-a", "1"))
+	if _, ok := c.epStore.Get("default/foo"); ok {
+		t.Fatal("expected default/foo to be removed")
+	}
+}
+
+func TestEndpointSliceV1(t *testing.T) {
+	c := newTestController(t)
+	if err := c.configStore.Load(testEDSConfigMap("default/foo")); err != nil {
+		t.Fatal(err)
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "discovery.k8s.io/v1",
+		"kind":       "EndpointSlice",
+		"metadata": map[string]interface{}{
+			"namespace":       "default",
+			"name":            "foo-a",
+			"resourceVersion": "1",
+			"labels":          map[string]interface{}{serviceNameLabel: "foo"},
+		},
+		"addressType": "IPv4",
+		"endpoints": []interface{}{
+			map[string]interface{}{
+				"addresses":  []interface{}{"10.0.0.1"},
+				"conditions": map[string]interface{}{"ready": true},
+				"zone":       "us-east1-b",
+				"nodeName":   "node-a",
+			},
+		},
+		"ports": []interface{}{
+			map[string]interface{}{"port": int64(8080)},
+		},
+	}}
+
+	client := &fakeSliceClient{slices: map[string][]unstructured.Unstructured{
+		"v1":      {*obj},
+		"v1beta1": {},
+	}}
+	v1Slices := endpointSliceResources[0]
+	ss := NewEpSliceStore(client, c.configStore, c.epStore)
+	if err := ss.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if ss.resource != v1Slices {
+		t.Fatalf("expected v1 to be watched, got %v", ss.resource)
+	}
+
+	ep, ok := c.epStore.Get("default/foo")
+	if !ok {
+		t.Fatal("missing default/foo")
+	}
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(ep.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	if len(cla.Endpoints) != 1 || cla.Endpoints[0].GetLocality().GetZone() != "us-east1-b" {
+		t.Fatalf("expected the zone of the endpoint: %v", &cla)
+	}
+}
+
+func TestEndpointSliceV1beta1Fallback(t *testing.T) {
+	c := newTestController(t)
+	// Clusters before Kubernetes 1.21 only serve v1beta1
+	client := &fakeSliceClient{slices: map[string][]unstructured.Unstructured{
+		"v1beta1": {},
+	}}
+	ss := NewEpSliceStore(client, c.configStore, c.epStore)
+	if err := ss.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if ss.resource.Version != "v1beta1" {
+		t.Fatalf("expected v1beta1 to be watched, got %v", ss.resource)
+	}
+}
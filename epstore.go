@@ -3,11 +3,16 @@ package main
 import (
 	"log"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 
 	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/any"
 	v1 "k8s.io/api/core/v1"
@@ -24,27 +29,73 @@ type EpStore struct {
 	store    cache.Store
 
 	configStore *ConfigStore
+	topology    *TopologyStore
+	pods        *PodStore
+	guard       *EpGuard
+	debounce    *Debouncer
 
+	// Index of the Kubernetes cluster watched and where its endpoints
+	// are merged with those of other clusters, nil with a single one
+	cluster int
+	merger  *EpMerger
+
+	// Serializes updates
+	mu sync.Mutex
+	// Cluster name -> *Endpoints
 	registry sync.Map
+	// Endpoints key -> *loadedService
+	services sync.Map
+
+	updates *notifier
 }
 
 type Endpoints struct {
-	version string
-	data    []byte
+	version  string
+	healthy  int
+	data     []byte
+	resource *any.Any
+	// Same ClusterLoadAssignment translated to the v3 API
+	dataV3     []byte
+	resourceV3 *any.Any
+}
+
+// Data returns the REST DiscoveryResponse for the given resource type.
+func (ep *Endpoints) Data(typeURL string) []byte {
+	if typeURL == resourcev3.EndpointType {
+		return ep.dataV3
+	}
+	return ep.data
+}
+
+func (ep *Endpoints) Resource(typeURL string) *any.Any {
+	if typeURL == resourcev3.EndpointType {
+		return ep.resourceV3
+	}
+	return ep.resource
 }
 
 func NewEpStore(
 	k8sClient *kubernetes.Clientset,
 	configStore *ConfigStore,
+	topology *TopologyStore,
+	pods *PodStore,
+	guard *EpGuard,
+	debounce *Debouncer,
 ) *EpStore {
 	es := &EpStore{
 		k8sClient:   k8sClient,
 		configStore: configStore,
+		topology:    topology,
+		pods:        pods,
+		guard:       guard,
+		debounce:    debounce,
+		updates:     newNotifier(),
 	}
 	infFactory := informers.NewSharedInformerFactoryWithOptions(k8sClient, 0,
 		informers.WithTweakListOptions(func(*metav1.ListOptions) {}))
 
 	es.informer = infFactory.Core().V1().Endpoints().Informer()
+	es.informer.AddIndexers(cache.Indexers{podIndex: endpointsPods})
 	es.store = es.informer.GetStore()
 	es.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -55,7 +106,7 @@ func NewEpStore(
 				return
 			}
 
-			es.LoadEp(obj.(*v1.Endpoints))
+			es.debounce.Do(key, func() { es.syncEp(key) })
 		},
 		UpdateFunc: func(old, cur interface{}) {
 			config := es.configStore.GetConfigSnapshot()
@@ -71,7 +122,7 @@ func NewEpStore(
 				return
 			}
 
-			es.LoadEp(cep)
+			es.debounce.Do(key, func() { es.syncEp(key) })
 		},
 		DeleteFunc: func(obj interface{}) {
 			config := es.configStore.GetConfigSnapshot()
@@ -81,7 +132,7 @@ func NewEpStore(
 				return
 			}
 
-			es.DeleteEp(key)
+			es.debounce.Do(key, func() { es.syncEp(key) })
 		},
 	})
 	return es
@@ -104,11 +155,136 @@ func (es *EpStore) Init() error {
 }
 
 func (es *EpStore) Run() {
-	es.informer.Run(nil)
+	go es.informer.Run(nil)
+	go es.watchPods(es.podServices, es.syncEp)
+
+	// Rebuild all endpoints when a node moves, or shows up late, and
+	// when clusters ask for another health status of not ready ones.
+	notReadyHealth := es.configStore.GetConfigSnapshot().notReadyHealth
+	for {
+		if !es.waitForRegroup(&notReadyHealth) {
+			continue
+		}
+		config := es.configStore.GetConfigSnapshot()
+		for _, obj := range es.store.List() {
+			ep := obj.(*v1.Endpoints)
+			if config.HasService(ep.GetNamespace() + "/" + ep.GetName()) {
+				es.storeEp(ep)
+			}
+		}
+	}
+}
+
+// Endpoints objects are loaded into one or more ClusterLoadAssignments,
+// one for every named port and one under the plain service name if
+// there is only a single port.
+type loadedService struct {
+	version string
+	names   []string
+}
+
+// Cluster names of EDS clusters are `namespace/service`, optionally
+// followed by `:port` to pick a named port of multi-port services.
+func splitServicePort(name string) (string, string) {
+	s := strings.SplitN(name, ":", 2)
+	if len(s) == 1 {
+		return s[0], ""
+	}
+	return s[0], s[1]
+}
+
+// waitForRegroup waits for a change of the localities or the health
+// status for not ready endpoints, and returns whether endpoints need to
+// be rebuilt.
+func (es *EpStore) waitForRegroup(notReadyHealth *map[string]core.HealthStatus) bool {
+	select {
+	case <-es.topology.Updates():
+		return true
+	case <-es.configStore.Updates():
+		config := es.configStore.GetConfigSnapshot()
+		if reflect.DeepEqual(config.notReadyHealth, *notReadyHealth) {
+			return false
+		}
+		*notReadyHealth = config.notReadyHealth
+		return true
+	}
 }
 
-func validSubset(subset v1.EndpointSubset) bool {
-	return len(subset.Ports) == 1
+// watchPods rebuilds the services with endpoints on pods whose metadata
+// changed, coalesced with other updates to them. services looks them up
+// by pod key, sync rebuilds one of them.
+func (es *EpStore) watchPods(services func(pods []string) []string, sync func(key string)) {
+	if es.pods == nil {
+		return
+	}
+	for {
+		updates := es.pods.Updates()
+		config := es.configStore.GetConfigSnapshot()
+		for _, key := range services(es.pods.Changed()) {
+			if !config.HasService(key) {
+				continue
+			}
+			key := key
+			es.debounce.Do(key, func() { sync(key) })
+		}
+		<-updates
+	}
+}
+
+// Index of Endpoints by the keys of the pods backing them
+const podIndex = "pods"
+
+func endpointsPods(obj interface{}) ([]string, error) {
+	ep := obj.(*v1.Endpoints)
+	var keys []string
+	for _, subset := range ep.Subsets {
+		for _, addresses := range [][]v1.EndpointAddress{subset.Addresses, subset.NotReadyAddresses} {
+			for _, address := range addresses {
+				if ref := address.TargetRef; ref != nil && ref.Kind == "Pod" {
+					keys = append(keys, ref.Namespace+"/"+ref.Name)
+				}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// podServices returns the keys of the Endpoints backed by any of pods.
+func (es *EpStore) podServices(pods []string) []string {
+	indexer := es.informer.GetIndexer()
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, pod := range pods {
+		objs, err := indexer.ByIndex(podIndex, pod)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		for _, obj := range objs {
+			key, _ := cache.MetaNamespaceKeyFunc(obj)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// syncEp loads the current state of a service from the informer. It is
+// rebuilt even if the Endpoints didn't change, as the pods backing them
+// may have.
+func (es *EpStore) syncEp(key string) {
+	obj, exists, err := es.store.GetByKey(key)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !exists {
+		es.deleteK8sService(key)
+		return
+	}
+	es.storeEp(obj.(*v1.Endpoints))
 }
 
 func (es *EpStore) LoadEp(ep *v1.Endpoints) {
@@ -116,81 +292,341 @@ func (es *EpStore) LoadEp(ep *v1.Endpoints) {
 	version := ep.ObjectMeta.ResourceVersion
 
 	// Check if the existing resource version is the same
-	if ep, ok := es.registry.Load(epKey); ok && ep.(*Endpoints).version == version {
+	old, ok := es.services.Load(epKey)
+	if ok && old.(*loadedService).version == version {
 		return
 	}
 
-	// Count how many registrations we need here
-	// so that we can correctly allocate what we need
-	n := 0
-	for _, subset := range ep.Subsets {
-		if !validSubset(subset) {
-			continue
+	es.storeEp(ep)
+}
+
+func (es *EpStore) storeEp(ep *v1.Endpoints) {
+	epKey := ep.GetNamespace() + "/" + ep.GetName()
+	es.storeK8sService(epKey, ep.ObjectMeta.ResourceVersion, es.clusterLoadAssignments(epKey, ep))
+}
+
+// storeK8sService stores a service read from Kubernetes, merged with
+// the same service in other clusters if there are any.
+func (es *EpStore) storeK8sService(epKey string, resourceVersion string, clas map[string]*v2.ClusterLoadAssignment) {
+	if es.merger == nil {
+		es.storeService(epKey, resourceVersion, clas)
+		return
+	}
+	es.merger.storeService(es.cluster, epKey, resourceVersion, clas)
+}
+
+func (es *EpStore) deleteK8sService(epKey string) {
+	if es.merger == nil {
+		es.DeleteEp(epKey)
+		return
+	}
+	es.merger.deleteService(es.cluster, epKey)
+}
+
+// storeService replaces the ClusterLoadAssignments of a service built
+// from resourceVersion. Each of them is versioned by content, as the same
+// resourceVersion may be regrouped, e.g. when nodes change zone.
+func (es *EpStore) storeService(epKey string, resourceVersion string, clas map[string]*v2.ClusterLoadAssignment) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	healthy := make(map[string]int, len(clas))
+	for name, cla := range clas {
+		if health := es.notReadyHealth(name); health != defaultNotReadyHealth {
+			clas[name] = withNotReadyHealth(cla, health)
 		}
-		n += len(subset.Addresses)
+		healthy[name] = countHealthy(clas[name])
 	}
+	es.guarded(epKey, healthy, func() {
+		es.applyService(epKey, resourceVersion, clas, healthy)
+	})
+}
+
+func (es *EpStore) applyService(epKey string, resourceVersion string, clas map[string]*v2.ClusterLoadAssignment, healthy map[string]int) {
+	old, ok := es.services.Load(epKey)
+	loaded := &loadedService{version: resourceVersion}
+	for name, cla := range clas {
+		version := contentVersion(cla)
+		r, _ := ptypes.MarshalAny(cla)
+		j, _ := structToJSON(&v2.DiscoveryResponse{
+			VersionInfo: version,
+			Resources:   []*any.Any{r},
+		})
 
-	cla := &v2.ClusterLoadAssignment{
-		ClusterName: epKey,
-		Endpoints: []*endpoint.LocalityLbEndpoints{{
-			LbEndpoints: make([]*endpoint.LbEndpoint, n),
-		}},
+		// Write entire DiscoveryResponse into the registry
+		ep := &Endpoints{
+			version:  version,
+			healthy:  healthy[name],
+			data:     j,
+			resource: r,
+		}
+		// v2 clients keep getting updates if translating fails
+		if claV3, err := toV3(cla); err != nil {
+			log.Printf("%s: %s", name, err)
+		} else {
+			ep.resourceV3, _ = ptypes.MarshalAny(claV3)
+			ep.dataV3, _ = structToJSON(&v2.DiscoveryResponse{
+				VersionInfo: version,
+				Resources:   []*any.Any{ep.resourceV3},
+			})
+		}
+		es.registry.Store(name, ep)
+		loaded.names = append(loaded.names, name)
 	}
 
-	n = 0
+	// Ports the service doesn't expose anymore
+	if ok {
+		for _, name := range old.(*loadedService).names {
+			if !containsString(loaded.names, name) {
+				es.registry.Delete(name)
+			}
+		}
+	}
+	es.services.Store(epKey, loaded)
+	es.updates.Notify()
+}
+
+// notReadyHealth returns the health status the clusters of a service
+// want for not ready endpoints.
+func (es *EpStore) notReadyHealth(name string) core.HealthStatus {
+	if es.configStore == nil {
+		return defaultNotReadyHealth
+	}
+	return es.configStore.GetConfigSnapshot().NotReadyHealth(name)
+}
+
+// withNotReadyHealth returns a copy of cla with not ready endpoints,
+// which are built with the default health status, set to health.
+func withNotReadyHealth(cla *v2.ClusterLoadAssignment, health core.HealthStatus) *v2.ClusterLoadAssignment {
+	cla = proto.Clone(cla).(*v2.ClusterLoadAssignment)
+	for _, localities := range cla.Endpoints {
+		for _, lbEndpoint := range localities.LbEndpoints {
+			if lbEndpoint.HealthStatus == defaultNotReadyHealth {
+				lbEndpoint.HealthStatus = health
+			}
+		}
+	}
+	return cla
+}
+
+// clusterLoadAssignments groups the addresses of ep by port and by the
+// locality of their node, keyed by cluster name.
+func (es *EpStore) clusterLoadAssignments(epKey string, ep *v1.Endpoints) map[string]*v2.ClusterLoadAssignment {
+	// Port name -> locality -> endpoints
+	ports := make(map[string]map[locality][]*endpoint.LbEndpoint)
 	for _, subset := range ep.Subsets {
-		if !validSubset(subset) {
-			continue
+		for _, port := range subset.Ports {
+			localities, ok := ports[port.Name]
+			if !ok {
+				localities = make(map[locality][]*endpoint.LbEndpoint)
+				ports[port.Name] = localities
+			}
+			add := func(address v1.EndpointAddress, health core.HealthStatus) {
+				var l locality
+				if address.NodeName != nil {
+					l = es.topology.Get(*address.NodeName)
+				}
+				lbEndpoint := newLbEndpoint(address.IP, port.Port)
+				lbEndpoint.HealthStatus = health
+				es.pods.Get(address.TargetRef).apply(lbEndpoint)
+				localities[l] = append(localities[l], lbEndpoint)
+				log.Printf("%s/%s:%d %s\n", ep.GetName(), address.IP, port.Port, health)
+			}
+			for _, address := range subset.Addresses {
+				add(address, core.HealthStatus_HEALTHY)
+			}
+			// Still there, e.g. while terminating, so that Envoy can
+			// drain them rather than having them vanish
+			for _, address := range subset.NotReadyAddresses {
+				add(address, defaultNotReadyHealth)
+			}
 		}
-		for _, address := range subset.Addresses {
-
-			cla.Endpoints[0].LbEndpoints[n] = &endpoint.LbEndpoint{
-				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-					Endpoint: &endpoint.Endpoint{
-						Address: &core.Address{
-							Address: &core.Address_SocketAddress{
-								SocketAddress: &core.SocketAddress{
-									Protocol: core.SocketAddress_TCP,
-									Address:  address.IP,
-									PortSpecifier: &core.SocketAddress_PortValue{
-										PortValue: uint32(subset.Ports[0].Port),
-									},
-								},
+	}
+
+	byPort := make(map[string][]*endpoint.LocalityLbEndpoints, len(ports))
+	for port, localities := range ports {
+		byPort[port] = localityLbEndpoints(localities)
+	}
+	return assignmentsByPort(epKey, byPort)
+}
+
+// localityLbEndpoints sorts endpoints grouped by locality by zone.
+func localityLbEndpoints(localities map[locality][]*endpoint.LbEndpoint) []*endpoint.LocalityLbEndpoints {
+	rv := make([]*endpoint.LocalityLbEndpoints, 0, len(localities))
+	for l, lbEndpoints := range localities {
+		rv = append(rv, &endpoint.LocalityLbEndpoints{
+			Locality:    l.Locality(),
+			LbEndpoints: lbEndpoints,
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		a, b := rv[i].GetLocality(), rv[j].GetLocality()
+		if a.GetRegion() != b.GetRegion() {
+			return a.GetRegion() < b.GetRegion()
+		}
+		return a.GetZone() < b.GetZone()
+	})
+	return rv
+}
+
+// assignmentsByPort builds the ClusterLoadAssignments of a service from
+// its endpoints grouped by port name.
+func assignmentsByPort(epKey string, ports map[string][]*endpoint.LocalityLbEndpoints) map[string]*v2.ClusterLoadAssignment {
+	clas := make(map[string]*v2.ClusterLoadAssignment)
+	add := func(name string, localities []*endpoint.LocalityLbEndpoints) {
+		clas[name] = &v2.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints:   localities,
+		}
+	}
+	for port, localities := range ports {
+		if port != "" {
+			add(epKey+":"+port, localities)
+		}
+		if len(ports) == 1 {
+			add(epKey, localities)
+		}
+	}
+	// Services without any ready endpoint still exist
+	if len(ports) == 0 {
+		add(epKey, []*endpoint.LocalityLbEndpoints{{
+			LbEndpoints: []*endpoint.LbEndpoint{},
+		}})
+	}
+	return clas
+}
+
+func newLbEndpoint(ip string, port int32) *endpoint.LbEndpoint {
+	return &endpoint.LbEndpoint{
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: &core.Address{
+					Address: &core.Address_SocketAddress{
+						SocketAddress: &core.SocketAddress{
+							Protocol: core.SocketAddress_TCP,
+							Address:  ip,
+							PortSpecifier: &core.SocketAddress_PortValue{
+								PortValue: uint32(port),
 							},
 						},
 					},
 				},
-			}
-			log.Printf("%s/%s:%d\n", ep.GetName(), address.IP, subset.Ports[0].Port)
-			n++
-		}
+			},
+		},
 	}
+}
 
-	r, _ := ptypes.MarshalAny(cla)
-	j, _ := structToJSON(&v2.DiscoveryResponse{
-		VersionInfo: version,
-		Resources:   []*any.Any{r},
-	})
-
-	// Write entire DiscoveryResponse into the registry
-	es.registry.Store(epKey, &Endpoints{
-		version: version,
-		data:    j,
+func (es *EpStore) DeleteEp(key string) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.guarded(key, nil, func() {
+		es.applyDelete(key)
 	})
 }
 
-func (es *EpStore) DeleteEp(key string) {
+func (es *EpStore) applyDelete(key string) {
 	log.Println("removing service: " + key)
-	es.registry.Delete(key)
+	if loaded, ok := es.services.Load(key); ok {
+		for _, name := range loaded.(*loadedService).names {
+			es.registry.Delete(name)
+		}
+	}
+	es.services.Delete(key)
+	es.updates.Notify()
+}
+
+// Updates returns a channel that is closed on the next endpoints change.
+func (es *EpStore) Updates() <-chan struct{} {
+	return es.updates.Wait()
 }
 
 func (es *EpStore) Get(key string) (*Endpoints, bool) {
 	// HACK: Strip an old k8s prefix
-	if key[:4] == "k8s:" {
-		key = key[4:]
-	}
+	key = strings.TrimPrefix(key, "k8s:")
 	if ep, ok := es.registry.Load(key); ok {
 		return ep.(*Endpoints), true
 	}
 	return nil, false
 }
+
+// getType returns the endpoints of a service if they can be served as
+// typeURL, which they can't as v3 if translating them failed.
+func (es *EpStore) getType(key string, typeURL string) (*Endpoints, bool) {
+	ep, ok := es.Get(key)
+	if !ok || ep.Resource(typeURL) == nil {
+		return nil, false
+	}
+	return ep, true
+}
+
+// GetResponse returns a DiscoveryResponse with the ClusterLoadAssignment
+// of every known service in names, or of all services if names is empty.
+// The version is derived from the versions of all included services.
+func (es *EpStore) GetResponse(typeURL string, names []string) *v2.DiscoveryResponse {
+	if len(names) == 0 {
+		names = es.names()
+	}
+	resources := make([]*any.Any, 0, len(names))
+	versions := make([]string, 0, len(names))
+	for _, name := range names {
+		ep, ok := es.getType(name, typeURL)
+		if !ok {
+			continue
+		}
+		resources = append(resources, ep.Resource(typeURL))
+		versions = append(versions, name+"="+ep.version)
+	}
+	return &v2.DiscoveryResponse{
+		VersionInfo: combineVersions(versions),
+		Resources:   resources,
+		TypeUrl:     typeURL,
+	}
+}
+
+// GetJSON returns the REST DiscoveryResponse for names along with its
+// version, or false if none of the services is known.
+func (es *EpStore) GetJSON(typeURL string, names []string) (string, []byte, bool) {
+	// A single service is already encoded
+	if len(names) == 1 {
+		if ep, ok := es.getType(names[0], typeURL); ok {
+			return ep.version, ep.Data(typeURL), true
+		}
+		return "", nil, false
+	}
+
+	resp := es.GetResponse(typeURL, names)
+	if len(resp.Resources) == 0 {
+		return "", nil, false
+	}
+	j, _ := structToJSON(&v2.DiscoveryResponse{
+		VersionInfo: resp.VersionInfo,
+		Resources:   resp.Resources,
+	})
+	return resp.VersionInfo, j, true
+}
+
+func (es *EpStore) names() []string {
+	names := make([]string, 0)
+	es.registry.Range(func(key, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// GetResources returns the ClusterLoadAssignment of every known
+// service in names keyed by name, for incremental xDS.
+func (es *EpStore) GetResources(typeURL string, names []string) map[string]*v2.Resource {
+	rv := make(map[string]*v2.Resource, len(names))
+	for _, name := range names {
+		if ep, ok := es.getType(name, typeURL); ok {
+			rv[name] = &v2.Resource{
+				Name:     name,
+				Version:  ep.version,
+				Resource: ep.Resource(typeURL),
+			}
+		}
+	}
+	return rv
+}
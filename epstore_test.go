@@ -0,0 +1,340 @@
+package main
+
+import (
+	"testing"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/golang/protobuf/ptypes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func multiPortEndpoints(version string, ports ...v1.EndpointPort) *v1.Endpoints {
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "snuba",
+			ResourceVersion: version,
+		},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+			Ports:     ports,
+		}},
+	}
+}
+
+func TestMultiPortEndpoints(t *testing.T) {
+	es := &EpStore{updates: newNotifier()}
+	es.LoadEp(multiPortEndpoints("1",
+		v1.EndpointPort{Name: "query", Port: 1218},
+		v1.EndpointPort{Name: "metrics", Port: 9090},
+	))
+
+	if _, ok := es.Get("default/snuba"); ok {
+		t.Fatal("multi-port services must be picked by port")
+	}
+	ep, ok := es.Get("default/snuba:query")
+	if !ok {
+		t.Fatal("missing default/snuba:query")
+	}
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(ep.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	lbEndpoints := cla.Endpoints[0].LbEndpoints
+	if cla.ClusterName != "default/snuba:query" || len(lbEndpoints) != 2 ||
+		lbEndpoints[0].GetEndpoint().Address.GetSocketAddress().GetPortValue() != 1218 {
+		t.Fatalf("unexpected assignment: %v", &cla)
+	}
+
+	// Dropping the metrics port makes it the only one
+	es.LoadEp(multiPortEndpoints("2", v1.EndpointPort{Name: "query", Port: 1218}))
+	if _, ok := es.Get("default/snuba:metrics"); ok {
+		t.Fatal("default/snuba:metrics was not removed")
+	}
+	for _, name := range []string{"default/snuba", "default/snuba:query"} {
+		if _, ok := es.Get(name); !ok {
+			t.Fatalf("missing %s", name)
+		}
+	}
+
+	es.DeleteEp("default/snuba")
+	if names := es.names(); len(names) != 0 {
+		t.Fatalf("expected no services, got %v", names)
+	}
+}
+
+func testEDSConfigMap(serviceName string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		Data: map[string]string{
+			"clusters": `
+- name: foo
+  type: EDS
+  eds_cluster_config:
+    service_name: ` + serviceName + `
+    eds_config:
+      api_config_source:
+        api_type: REST
+        cluster_names: [xds]
+        refresh_delay: 10s
+`,
+		},
+	}
+}
+
+func TestConfigNamedPortService(t *testing.T) {
+	config := NewConfig()
+	if err := config.Load(testEDSConfigMap("default/snuba:query")); err != nil {
+		t.Fatal(err)
+	}
+	if !config.HasService("default/snuba") {
+		t.Fatal("default/snuba must be watched")
+	}
+}
+
+func testNode(name, zone string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				regionLabel: "us-east1",
+				zoneLabel:   zone,
+			},
+		},
+	}
+}
+
+func TestEndpointsGroupedByZone(t *testing.T) {
+	topology := &TopologyStore{updates: newNotifier()}
+	topology.LoadNode(testNode("node-a", "us-east1-b"))
+	topology.LoadNode(testNode("node-b", "us-east1-c"))
+	es := &EpStore{topology: topology, updates: newNotifier()}
+
+	nodeA, nodeB := "node-a", "node-b"
+	ep := testEndpoints("foo", "1", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	ep.Subsets[0].Addresses[0].NodeName = &nodeA
+	ep.Subsets[0].Addresses[1].NodeName = &nodeB
+	ep.Subsets[0].Addresses[2].NodeName = &nodeB
+	es.LoadEp(ep)
+
+	loaded, _ := es.Get("default/foo")
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(loaded.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	if len(cla.Endpoints) != 2 ||
+		cla.Endpoints[0].Locality.Zone != "us-east1-b" || len(cla.Endpoints[0].LbEndpoints) != 1 ||
+		cla.Endpoints[1].Locality.Zone != "us-east1-c" || len(cla.Endpoints[1].LbEndpoints) != 2 {
+		t.Fatalf("expected endpoints grouped by zone: %v", &cla)
+	}
+
+	// Same endpoints, but a node changed zone
+	topology.LoadNode(testNode("node-b", "us-east1-b"))
+	es.storeEp(ep)
+	regrouped, _ := es.Get("default/foo")
+	if regrouped.version == loaded.version {
+		t.Fatal("expected a new version after regrouping")
+	}
+	if err := ptypes.UnmarshalAny(regrouped.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	if len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 3 {
+		t.Fatalf("expected a single zone: %v", &cla)
+	}
+}
+
+func TestNotReadyAddresses(t *testing.T) {
+	configStore := &ConfigStore{updates: newNotifier()}
+	cm := testEDSConfigMap("default/foo")
+	cm.Data["clusters"] += `
+- name: bar
+  type: EDS
+  metadata:
+    filter_metadata:
+      xds:
+        not_ready: UNHEALTHY
+  eds_cluster_config:
+    service_name: default/bar
+    eds_config:
+      api_config_source:
+        api_type: REST
+        cluster_names: [xds]
+        refresh_delay: 10s
+`
+	if err := configStore.Load(cm); err != nil {
+		t.Fatal(err)
+	}
+	es := &EpStore{configStore: configStore, updates: newNotifier()}
+
+	expected := map[string]core.HealthStatus{
+		"foo": core.HealthStatus_DRAINING,
+		"bar": core.HealthStatus_UNHEALTHY,
+	}
+	for name, health := range expected {
+		ep := testEndpoints(name, "1", "10.0.0.1")
+		ep.Subsets[0].NotReadyAddresses = []v1.EndpointAddress{{IP: "10.0.0.2"}}
+		es.LoadEp(ep)
+
+		loaded, _ := es.Get("default/" + name)
+		var cla v2.ClusterLoadAssignment
+		if err := ptypes.UnmarshalAny(loaded.resource, &cla); err != nil {
+			t.Fatal(err)
+		}
+		lbEndpoints := cla.Endpoints[0].LbEndpoints
+		if len(lbEndpoints) != 2 ||
+			lbEndpoints[0].HealthStatus != core.HealthStatus_HEALTHY ||
+			lbEndpoints[1].HealthStatus != health {
+			t.Fatalf("expected the not ready address of %s to be %s: %v", name, health, &cla)
+		}
+	}
+}
+
+func TestConfigConflictingNotReady(t *testing.T) {
+	cm := testEDSConfigMap("default/foo")
+	cm.Data["clusters"] += `
+- name: foo-unhealthy
+  type: EDS
+  metadata:
+    filter_metadata:
+      xds:
+        not_ready: UNHEALTHY
+  eds_cluster_config:
+    service_name: default/foo
+    eds_config:
+      api_config_source:
+        api_type: REST
+        cluster_names: [xds]
+        refresh_delay: 10s
+`
+	if err := NewConfig().Load(cm); err == nil {
+		t.Fatal("expected clusters of the same service to conflict")
+	}
+}
+
+func TestEndpointsPodMetadata(t *testing.T) {
+	pods := &PodStore{weights: true, lbLabels: []string{"version"}, updates: newNotifier()}
+	pods.LoadPod(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo-canary",
+			Annotations: map[string]string{weightAnnotation: "5"},
+			Labels:      map[string]string{"version": "canary", "app": "foo"},
+		},
+	})
+	es := &EpStore{pods: pods, updates: newNotifier()}
+
+	ep := testEndpoints("foo", "1", "10.0.0.1", "10.0.0.2")
+	ep.Subsets[0].Addresses[0].TargetRef = &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-canary"}
+	ep.Subsets[0].Addresses[1].TargetRef = &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-stable"}
+	es.LoadEp(ep)
+
+	loaded, _ := es.Get("default/foo")
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(loaded.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	canary, stable := cla.Endpoints[0].LbEndpoints[0], cla.Endpoints[0].LbEndpoints[1]
+	if canary.LoadBalancingWeight.GetValue() != 5 {
+		t.Fatalf("expected a weight of 5: %v", canary)
+	}
+	labels := canary.Metadata.FilterMetadata[lbMetadataKey].Fields
+	if len(labels) != 1 || labels["version"].GetStringValue() != "canary" {
+		t.Fatalf("expected only the version label: %v", canary)
+	}
+	if stable.LoadBalancingWeight != nil || stable.Metadata != nil {
+		t.Fatalf("unexpected weight or metadata: %v", stable)
+	}
+}
+
+func TestEndpointsWithoutV3(t *testing.T) {
+	es := &EpStore{updates: newNotifier()}
+	es.LoadEp(testEndpoints("foo", "1", "10.0.0.1"))
+	// As left when translating to v3 fails
+	ep, _ := es.Get("default/foo")
+	es.registry.Store("default/foo", &Endpoints{version: ep.version, data: ep.data, resource: ep.resource})
+
+	if resp := es.GetResponse(resource.EndpointType, []string{"default/foo"}); len(resp.Resources) != 1 {
+		t.Fatalf("expected v2 endpoints to be served, got %v", resp)
+	}
+	if resp := es.GetResponse(resourcev3.EndpointType, []string{"default/foo"}); len(resp.Resources) != 0 {
+		t.Fatalf("expected no v3 endpoints, got %v", resp)
+	}
+	if _, _, ok := es.GetJSON(resourcev3.EndpointType, []string{"default/foo"}); ok {
+		t.Fatal("expected no v3 endpoints")
+	}
+	if rs := es.GetResources(resourcev3.EndpointType, []string{"default/foo"}); len(rs) != 0 {
+		t.Fatalf("expected no v3 endpoints, got %v", rs)
+	}
+}
+
+func TestPodWeightsDisabled(t *testing.T) {
+	pods := &PodStore{lbLabels: []string{"version"}, updates: newNotifier()}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo-canary",
+			Annotations: map[string]string{weightAnnotation: "5"},
+		},
+	}
+	pods.LoadPod(pod)
+	if md := pods.Get(&v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-canary"}); md != nil {
+		t.Fatalf("expected the weight to be ignored, got %+v", md)
+	}
+
+	pod.Labels = map[string]string{"version": "canary"}
+	pods.LoadPod(pod)
+	md := pods.Get(&v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-canary"})
+	if md == nil || md.weight != 0 || md.labels["version"] != "canary" {
+		t.Fatalf("expected only the label, got %+v", md)
+	}
+}
+
+func TestPodChangeRebuildsItsServices(t *testing.T) {
+	pods := &PodStore{weights: true, updates: newNotifier()}
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1.Endpoints{}, 0,
+		cache.Indexers{podIndex: endpointsPods})
+	es := &EpStore{pods: pods, informer: informer, store: informer.GetStore(), updates: newNotifier()}
+
+	foo := testEndpoints("foo", "1", "10.0.0.1")
+	foo.Subsets[0].Addresses[0].TargetRef = &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "foo-1"}
+	bar := testEndpoints("bar", "1", "10.0.0.2")
+	bar.Subsets[0].Addresses[0].TargetRef = &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "bar-1"}
+	for _, ep := range []*v1.Endpoints{foo, bar} {
+		es.store.Add(ep)
+		es.LoadEp(ep)
+	}
+
+	pods.LoadPod(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo-1",
+			Annotations: map[string]string{weightAnnotation: "5"},
+		},
+	})
+	changed := pods.Changed()
+	if len(changed) != 1 || changed[0] != "default/foo-1" {
+		t.Fatalf("expected foo-1 to have changed, got %v", changed)
+	}
+	if changed := pods.Changed(); len(changed) != 0 {
+		t.Fatalf("expected changes to be taken once, got %v", changed)
+	}
+	services := es.podServices(changed)
+	if len(services) != 1 || services[0] != "default/foo" {
+		t.Fatalf("expected only default/foo to be rebuilt, got %v", services)
+	}
+
+	// Rebuilt although the Endpoints are the same
+	es.syncEp("default/foo")
+	loaded, _ := es.Get("default/foo")
+	var cla v2.ClusterLoadAssignment
+	if err := ptypes.UnmarshalAny(loaded.resource, &cla); err != nil {
+		t.Fatal(err)
+	}
+	if w := cla.Endpoints[0].LbEndpoints[0].GetLoadBalancingWeight().GetValue(); w != 5 {
+		t.Fatalf("expected a weight of 5, got %d", w)
+	}
+}
@@ -3,6 +3,7 @@ module xds
 go 1.15
 
 require (
+	github.com/cncf/udpa/go v0.0.0-20201120205902-5459f2c99403
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/envoyproxy/go-control-plane v0.9.8
 	github.com/ghodss/yaml v1.0.0 // indirect
@@ -25,6 +26,9 @@ require (
 	github.com/stretchr/testify v1.6.1 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
+	google.golang.org/grpc v1.27.0
+	google.golang.org/protobuf v1.23.0
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	k8s.io/api v0.0.0-20181121071145-b7bd5f2d334c
 	k8s.io/apimachinery v0.0.0-20181126122622-195a1699ff5c
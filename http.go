@@ -9,6 +9,8 @@ import (
 
 	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/golang/protobuf/jsonpb"
 	v1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/yaml"
@@ -16,18 +18,43 @@ import (
 
 type xDSHandler struct {
 	controller *Controller
+	// How long a discovery request for the current version may
+	// wait for a change, zero disables long polling.
+	longPoll time.Duration
 }
 
 func (h *xDSHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.URL.Path {
 	case "/v2/discovery:endpoints":
-		h.handleEDS(w, req)
+		h.handleEDS(w, req, resource.EndpointType)
 	case "/v2/discovery:listeners":
-		h.handleLDS(w, req)
+		h.handleLDS(w, req, resource.ListenerType)
 	case "/v2/discovery:clusters":
-		h.handleCDS(w, req)
+		h.handleCDS(w, req, resource.ClusterType)
+	case "/v2/discovery:routes":
+		h.handleRDS(w, req, resource.RouteType)
+	case "/v2/discovery:secrets":
+		h.handleSDS(w, req, resource.SecretType)
+	case "/v2/discovery:runtime":
+		h.handleRTDS(w, req, resource.RuntimeType)
+	case "/v3/discovery:endpoints":
+		h.handleEDS(w, req, resourcev3.EndpointType)
+	case "/v3/discovery:listeners":
+		h.handleLDS(w, req, resourcev3.ListenerType)
+	case "/v3/discovery:clusters":
+		h.handleCDS(w, req, resourcev3.ClusterType)
+	case "/v3/discovery:routes":
+		h.handleRDS(w, req, resourcev3.RouteType)
+	case "/v3/discovery:secrets":
+		h.handleSDS(w, req, resourcev3.SecretType)
+	case "/v3/discovery:runtime":
+		h.handleRTDS(w, req, resourcev3.RuntimeType)
 	case "/config":
 		h.handleConfig(w, req)
+	case "/nodes":
+		h.handleNodes(w, req)
+	case "/held-endpoints":
+		h.handleHeldEndpoints(w, req)
 	case "/bootstrap":
 		h.handleBootstrap(w, req)
 	case "/validate":
@@ -68,7 +95,7 @@ func (h *xDSHandler) handleValidate(w http.ResponseWriter, req *http.Request) {
 }
 
 // Endpoint Discovery Service
-func (h *xDSHandler) handleEDS(w http.ResponseWriter, req *http.Request) {
+func (h *xDSHandler) handleEDS(w http.ResponseWriter, req *http.Request, typeURL string) {
 	if req.Method != "POST" {
 		http.Error(w, "method not allowed", 405)
 		return
@@ -80,25 +107,66 @@ func (h *xDSHandler) handleEDS(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	h.track(dr, typeURL)
+
+	// Any number of services may be requested at once, none means all
+	deadline := time.Now().Add(h.longPoll)
+	for {
+		updates := h.controller.epStore.Updates()
+		version, data, ok := h.controller.epStore.GetJSON(typeURL, dr.ResourceNames)
+		if !ok {
+			http.Error(w, "not found", 404)
+			return
+		}
+		if version == dr.VersionInfo {
+			if h.wait(req, updates, deadline) {
+				continue
+			}
+			w.WriteHeader(304)
+			return
+		}
+		h.sent(dr, typeURL, version)
+		w.Write(data)
+		return
+	}
+}
 
-	if len(dr.ResourceNames) != 1 {
-		http.Error(w, "must have 1 resource_names", 400)
+// Listener Discovery Service
+func (h *xDSHandler) handleLDS(w http.ResponseWriter, req *http.Request, typeURL string) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
 		return
 	}
 
-	if ep, ok := h.controller.GetEndpoints(dr.ResourceNames[0]); ok {
-		if ep.version == dr.VersionInfo {
-			w.WriteHeader(304)
-			return
-		}
-		w.Write(ep.data)
+	dr, err := readDiscoveryRequest(req)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.track(dr, typeURL)
+
+	if dr.Node == nil {
+		http.Error(w, "missing node", 400)
+		return
+	}
+
+	c, version, changed := h.waitForConfig(req, dr, typeURL)
+	if !changed {
+		w.WriteHeader(304)
+		return
+	}
+
+	if b, ok := c.GetJSON(typeURL, dr.Node); ok {
+		h.sent(dr, typeURL, version)
+		w.Write(b)
 	} else {
 		http.Error(w, "not found", 404)
 	}
 }
 
-// Listener Discovery Service
-func (h *xDSHandler) handleLDS(w http.ResponseWriter, req *http.Request) {
+// Cluster Discovery Service
+func (h *xDSHandler) handleCDS(w http.ResponseWriter, req *http.Request, typeURL string) {
 	if req.Method != "POST" {
 		http.Error(w, "method not allowed", 405)
 		return
@@ -110,22 +178,65 @@ func (h *xDSHandler) handleLDS(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	h.track(dr, typeURL)
+
+	if dr.Node == nil {
+		http.Error(w, "missing node", 400)
+		return
+	}
 
-	c := h.controller.GetConfigSnapshot()
-	if c.version == dr.VersionInfo {
+	c, version, changed := h.waitForConfig(req, dr, typeURL)
+	if !changed {
 		w.WriteHeader(304)
 		return
 	}
 
-	if b, ok := c.GetListeners(dr.Node); ok {
+	if b, ok := c.GetJSON(typeURL, dr.Node); ok {
+		h.sent(dr, typeURL, version)
 		w.Write(b)
 	} else {
 		http.Error(w, "not found", 404)
 	}
 }
 
-// Cluster Discovery Service
-func (h *xDSHandler) handleCDS(w http.ResponseWriter, req *http.Request) {
+// Route Discovery Service
+func (h *xDSHandler) handleRDS(w http.ResponseWriter, req *http.Request, typeURL string) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	dr, err := readDiscoveryRequest(req)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.track(dr, typeURL)
+
+	if dr.Node == nil {
+		http.Error(w, "missing node", 400)
+		return
+	}
+
+	c, _, changed := h.waitForConfig(req, dr, typeURL)
+	if !changed {
+		w.WriteHeader(304)
+		return
+	}
+
+	// Envoy asks for the route configurations it needs by name
+	if resp, ok := c.GetResponse(typeURL, dr.Node, dr.ResourceNames); ok {
+		h.sent(dr, typeURL, resp.VersionInfo)
+		b, _ := structToJSON(resp)
+		w.Write(b)
+	} else {
+		http.Error(w, "not found", 404)
+	}
+}
+
+// Runtime Discovery Service
+func (h *xDSHandler) handleRTDS(w http.ResponseWriter, req *http.Request, typeURL string) {
 	if req.Method != "POST" {
 		http.Error(w, "method not allowed", 405)
 		return
@@ -137,20 +248,136 @@ func (h *xDSHandler) handleCDS(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	h.track(dr, typeURL)
+
+	if dr.Node == nil {
+		http.Error(w, "missing node", 400)
+		return
+	}
 
-	c := h.controller.GetConfigSnapshot()
-	if c.version == dr.VersionInfo {
+	c, _, changed := h.waitForConfig(req, dr, typeURL)
+	if !changed {
 		w.WriteHeader(304)
 		return
 	}
 
-	if b, ok := c.GetClusters(dr.Node); ok {
+	// Envoy asks for its runtime layers by name
+	if resp, ok := c.GetResponse(typeURL, dr.Node, dr.ResourceNames); ok {
+		h.sent(dr, typeURL, resp.VersionInfo)
+		b, _ := structToJSON(resp)
 		w.Write(b)
 	} else {
 		http.Error(w, "not found", 404)
 	}
 }
 
+// Secret Discovery Service
+func (h *xDSHandler) handleSDS(w http.ResponseWriter, req *http.Request, typeURL string) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	dr, err := readDiscoveryRequest(req)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.track(dr, typeURL)
+
+	if dr.Node == nil {
+		http.Error(w, "missing node", 400)
+		return
+	}
+
+	deadline := time.Now().Add(h.longPoll)
+	for {
+		updates := h.controller.secretStore.Updates()
+		resp, _ := h.controller.GetResponse(typeURL, dr.Node, dr.ResourceNames)
+		if len(resp.Resources) == 0 {
+			http.Error(w, "not found", 404)
+			return
+		}
+		if resp.VersionInfo == dr.VersionInfo {
+			if h.wait(req, updates, deadline) {
+				continue
+			}
+			w.WriteHeader(304)
+			return
+		}
+
+		h.sent(dr, typeURL, resp.VersionInfo)
+		b, _ := structToJSON(resp)
+		w.Write(b)
+		return
+	}
+}
+
+// waitForConfig returns the current config snapshot, the version of the
+// node's resources and whether it differs from the requested version.
+// With long polling enabled, a request for the current version waits
+// for a change.
+func (h *xDSHandler) waitForConfig(req *http.Request, dr *v2.DiscoveryRequest, typeURL string) (*Config, string, bool) {
+	deadline := time.Now().Add(h.longPoll)
+	for {
+		updates := h.controller.configStore.Updates()
+		c := h.controller.GetConfigSnapshot()
+		resp, ok := c.GetResponse(typeURL, dr.Node, dr.ResourceNames)
+		// Unknown nodes are not our business here
+		if !ok {
+			return c, "", true
+		}
+		if resp.VersionInfo != dr.VersionInfo {
+			return c, resp.VersionInfo, true
+		}
+		if !h.wait(req, updates, deadline) {
+			return c, resp.VersionInfo, false
+		}
+	}
+}
+
+// track records whether the node accepted what it was sent last. REST
+// requests carry the last accepted version, and the error if the one
+// after it was rejected.
+func (h *xDSHandler) track(dr *v2.DiscoveryRequest, typeURL string) {
+	if dr.Node == nil {
+		return
+	}
+	if dr.ErrorDetail != nil {
+		log.Printf("%s rejected %s: %s", dr.Node.Id, typeURL, dr.ErrorDetail.Message)
+		h.controller.nodeStore.Nack(dr.Node, typeURL, dr.ErrorDetail.Message)
+	} else if dr.VersionInfo != "" {
+		h.controller.nodeStore.Ack(dr.Node, typeURL, dr.VersionInfo)
+	}
+}
+
+func (h *xDSHandler) sent(dr *v2.DiscoveryRequest, typeURL string, version string) {
+	if dr.Node != nil {
+		h.controller.nodeStore.Sent(dr.Node, typeURL, version)
+	}
+}
+
+// wait blocks until updates fires, returning false if the deadline
+// passes or the client goes away first.
+func (h *xDSHandler) wait(req *http.Request, updates <-chan struct{}, deadline time.Time) bool {
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-updates:
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
 func (h *xDSHandler) handleConfig(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		http.Error(w, "method not allowed", 405)
@@ -171,7 +398,7 @@ func (h *xDSHandler) handleConfig(w http.ResponseWriter, req *http.Request) {
 		LastError  string    `json:"last_error"`
 		LastUpdate time.Time `json:"last_update"`
 	}{
-		h.controller.configStore.config.version,
+		h.controller.GetConfigSnapshot().version,
 		lastError,
 		lastUpdate,
 	})
@@ -180,6 +407,30 @@ func (h *xDSHandler) handleConfig(w http.ResponseWriter, req *http.Request) {
 	w.Write(j)
 }
 
+// handleNodes dumps what every node has been sent, and whether it
+// accepted it.
+func (h *xDSHandler) handleNodes(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	j, _ := json.Marshal(h.controller.nodeStore.Nodes())
+	w.Write(j)
+}
+
+// handleHeldEndpoints dumps the endpoint updates currently held back
+// by the guard.
+func (h *xDSHandler) handleHeldEndpoints(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	j, _ := json.Marshal(h.controller.epStore.Held())
+	w.Write(j)
+}
+
 func (h *xDSHandler) handleBootstrap(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		http.Error(w, "method not allowed", 405)
@@ -242,6 +493,8 @@ func (h *xDSHandler) handleBootstrap(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Both v2 and v3 requests are read as v2, the JSON representation
+// of what we care about is the same.
 func readDiscoveryRequest(req *http.Request) (*v2.DiscoveryRequest, error) {
 	var dr v2.DiscoveryRequest
 	err := (&jsonpb.Unmarshaler{
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
 )
 
 func TestValidateHandler405(t *testing.T) {
@@ -113,3 +117,189 @@ data:
 		t.Fatal("Even an empty body is valid configmap.")
 	}
 }
+
+func currentVersion(t *testing.T, h http.Handler, path string, body string) string {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var resp struct {
+		VersionInfo string `json:"version_info"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.VersionInfo
+}
+
+func TestLDSLongPoll(t *testing.T) {
+	c := newTestController(t)
+	h := &xDSHandler{controller: c, longPoll: time.Second}
+	version := currentVersion(t, h, "/v2/discovery:listeners", `{"node": {"id": "a", "cluster": "foo"}}`)
+	body := `{"version_info": "` + version + `", "node": {"id": "a", "cluster": "foo"}}`
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req, _ := http.NewRequest("POST", "/v2/discovery:listeners", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		done <- rr
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("request for the current version should wait for a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := c.configStore.Load(testConfigMap("2", "bar")); err != nil {
+		t.Fatal(err)
+	}
+	rr := <-done
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), version) {
+		t.Fatalf("expected the new version, got %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestLDSLongPollTimeout(t *testing.T) {
+	h := &xDSHandler{controller: newTestController(t), longPoll: 10 * time.Millisecond}
+	version := currentVersion(t, h, "/v2/discovery:listeners", `{"node": {"id": "a", "cluster": "foo"}}`)
+	req, _ := http.NewRequest(
+		"POST",
+		"/v2/discovery:listeners",
+		strings.NewReader(`{"version_info": "`+version+`", "node": {"id": "a", "cluster": "foo"}}`),
+	)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 after the timeout, got %d", rr.Code)
+	}
+}
+
+func TestMissingNode(t *testing.T) {
+	h := &xDSHandler{controller: newTestController(t)}
+	for _, path := range []string{
+		"/v2/discovery:listeners",
+		"/v2/discovery:clusters",
+		"/v2/discovery:routes",
+		"/v2/discovery:runtime",
+	} {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(`{"version_info": "1"}`))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestEDSBatch(t *testing.T) {
+	c := newTestController(t)
+	c.epStore.LoadEp(testEndpoints("foo", "1", "10.0.0.1"))
+	c.epStore.LoadEp(testEndpoints("bar", "1", "10.0.0.2"))
+	h := &xDSHandler{controller: c}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v2/discovery:endpoints", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post(`{"node": {"id": "a"}, "resource_names": ["default/foo", "default/bar", "default/baz"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var resp struct {
+		VersionInfo string        `json:"version_info"`
+		Resources   []interface{} `json:"resources"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Resources) != 2 {
+		t.Fatalf("expected both known services, got %s", rr.Body)
+	}
+
+	rr = post(`{"node": {"id": "a"}, "resource_names": ["default/bar", "default/foo"], "version_info": "` + resp.VersionInfo + `"}`)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for the combined version, got %d", rr.Code)
+	}
+
+	rr = post(`{"node": {"id": "a"}}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "default/foo") || !strings.Contains(rr.Body.String(), "default/bar") {
+		t.Fatalf("expected all services without resource_names, got %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestEDSShortResourceNames(t *testing.T) {
+	c := newTestController(t)
+	c.epStore.LoadEp(testEndpoints("foo", "1", "10.0.0.1"))
+	h := &xDSHandler{controller: c}
+
+	for _, body := range []string{
+		`{"node": {"id": "a"}, "resource_names": ["a"]}`,
+		`{"node": {"id": "a"}, "resource_names": ["x/y", "default/foo"]}`,
+	} {
+		req, _ := http.NewRequest("POST", "/v2/discovery:endpoints", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code >= http.StatusInternalServerError {
+			t.Fatalf("unexpected %d for %s", rr.Code, body)
+		}
+	}
+}
+
+func TestLDSVersionFollowsContent(t *testing.T) {
+	c := newTestController(t)
+	h := &xDSHandler{controller: c}
+	body := `{"node": {"id": "a", "cluster": "foo"}}`
+	version := currentVersion(t, h, "/v2/discovery:listeners", body)
+
+	// Same listeners under a new configmap version
+	if err := c.configStore.Load(testConfigMap("2", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t, h, "/v2/discovery:listeners", body); v != version {
+		t.Fatalf("version changed from %s to %s without a change to the listeners", version, v)
+	}
+
+	if err := c.configStore.Load(testConfigMap("3", "bar")); err != nil {
+		t.Fatal(err)
+	}
+	if v := currentVersion(t, h, "/v2/discovery:listeners", body); v == version {
+		t.Fatal("version must change with the listeners")
+	}
+}
+
+func TestNodesTracksNACK(t *testing.T) {
+	c := newTestController(t)
+	h := &xDSHandler{controller: c}
+	version := currentVersion(t, h, "/v2/discovery:listeners", `{"node": {"id": "a", "cluster": "foo"}}`)
+
+	if err := c.configStore.Load(testConfigMap("2", "bar")); err != nil {
+		t.Fatal(err)
+	}
+	newVersion := currentVersion(t, h, "/v2/discovery:listeners", `{"version_info": "`+version+`", "node": {"id": "a", "cluster": "foo"}}`)
+	currentVersion(t, h, "/v2/discovery:listeners", `{
+		"version_info": "`+version+`",
+		"node": {"id": "a", "cluster": "foo"},
+		"error_detail": {"message": "bad listener"}
+	}`)
+
+	req, _ := http.NewRequest("GET", "/nodes", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var nodes map[string]*NodeStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	status := nodes["a"].Types[resource.ListenerType]
+	if status.Acked != version || status.Sent != newVersion ||
+		status.Rejected != newVersion || status.Error != "bad listener" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
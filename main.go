@@ -2,32 +2,46 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/health_check/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/ratelimit/v3"
 	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/redis_proxy/v3"
 	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
 
 	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/health_check/v2"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/router/v2"
 	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/rate_limit/v2"
 	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/redis_proxy/v2"
 	_ "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	runtimev3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+	secretv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/go-homedir"
+	"google.golang.org/grpc"
 	"sigs.k8s.io/yaml"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
@@ -36,15 +50,31 @@ import (
 )
 
 var (
-	mode             = flag.String("mode", "server", "what mode to run xds in (server / proxy)")
-	upstreamProxy    = flag.String("upstream-proxy", "", "upstream proxy (if running in proxy mode)")
-	configName       = flag.String("config-name", "", "configmap name to use for xds configuration (if running in server mode)")
-	bootstrapDataDir = flag.String("bootstrap-data", "", "bootstrap data directory (if running in proxy mode)")
-	serviceNode      = flag.String("service-node", "", "service node name")
-	serviceCluster   = flag.String("service-cluster", "", "service cluster name")
-	concurrency      = flag.Int("concurrency", 1, "envoy concurrency")
-	listen           = flag.String("listen", "", "listen address for web service")
-	validate         = flag.String("validate", "", "Path to config map to validate. `-` reads from stdin.")
+	mode              = flag.String("mode", "server", "what mode to run xds in (server / proxy)")
+	upstreamProxy     = flag.String("upstream-proxy", "", "upstream proxy (if running in proxy mode)")
+	configName        = flag.String("config-name", "", "configmap name to use for xds configuration (if running in server mode)")
+	bootstrapDataDir  = flag.String("bootstrap-data", "", "bootstrap data directory (if running in proxy mode)")
+	serviceNode       = flag.String("service-node", "", "service node name")
+	serviceCluster    = flag.String("service-cluster", "", "service cluster name")
+	concurrency       = flag.Int("concurrency", 1, "envoy concurrency")
+	listen            = flag.String("listen", "", "listen address for web service")
+	grpcListen        = flag.String("grpc-listen", "", "listen address for the gRPC ADS service (if running in server mode)")
+	configSelector    = flag.String("config-selector", "", "label selector of further configmaps, in any namespace, merged into the one of -config-name (if running in server mode)")
+	configFile        = flag.String("config-file", "", "configmap manifest, or directory with a file per section, to read the configuration from instead of Kubernetes (if running in server mode)")
+	crds              = flag.Bool("crds", false, "load XdsListener, XdsRoute, XdsCluster and XdsAssignment custom resources along with the configmap (if running in server mode)")
+	endpointSlices    = flag.Bool("endpoint-slices", false, "watch EndpointSlices instead of Endpoints (if running in server mode)")
+	zones             = flag.Bool("zones", false, "group endpoints by the zone of the node their pod runs on, which requires watching nodes (if running in server mode)")
+	podWeights        = flag.Bool("pod-weights", false, "take the load balancing weight of endpoints from the xds.sentry.io/weight annotation of their pod, which requires watching pods (if running in server mode)")
+	lbLabels          = flag.String("lb-labels", "", "comma separated pod labels copied into the envoy.lb metadata of endpoints (if running in server mode)")
+	endpointsFile     = flag.String("endpoints-file", "", "YAML or JSON file with endpoints of services outside of Kubernetes (if running in server mode)")
+	dnsServer         = flag.String("dns-server", "", "address of the DNS server resolving dns-srv: services, instead of the system's (if running in server mode)")
+	kubeContexts      = flag.String("kube-contexts", "", "comma separated kubeconfig contexts of further Kubernetes clusters to read endpoints from (if running in server mode)")
+	endpointsGrace    = flag.Duration("endpoints-grace", 0, "how long updates dropping all, or too many, endpoints of a service are held back (if running in server mode)")
+	maxEndpointDrop   = flag.Int("max-endpoint-drop", 0, "largest share of endpoints in percent a service may lose at once without being held back (if running in server mode)")
+	endpointsDebounce = flag.Duration("endpoints-debounce", 0, "how long to wait for further changes to a service's endpoints before serving them (if running in server mode)")
+	endpointsMaxDelay = flag.Duration("endpoints-max-delay", 0, "how long endpoint changes may be delayed at most by debouncing, defaults to 10 times -endpoints-debounce (if running in server mode)")
+	longPoll          = flag.Duration("long-poll", 0, "how long REST discovery requests for the current version wait for a change (if running in server mode)")
+	validate          = flag.String("validate", "", "Path to config map to validate. `-` reads from stdin.")
 )
 
 // ReadFileorStdin returns content of file or stdin.
@@ -97,21 +127,149 @@ func K8SConfig() (*rest.Config, error) {
 	return config, nil
 }
 
+// RemoteCluster is a further Kubernetes cluster endpoints are read from.
+type RemoteCluster struct {
+	Name          string
+	Client        *kubernetes.Clientset
+	DynamicClient dynamic.Interface
+}
+
+// NewRemoteCluster sets up clients for a context of the kubeconfig.
+func NewRemoteCluster(context string) (RemoteCluster, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+	if err != nil {
+		return RemoteCluster{}, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return RemoteCluster{}, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return RemoteCluster{}, err
+	}
+	return RemoteCluster{Name: context, Client: client, DynamicClient: dynamicClient}, nil
+}
+
 func runServerMode() {
+	flag.Parse()
+
+	var err error
+	if *endpointsGrace == 0 {
+		if v := os.Getenv("XDS_ENDPOINTS_GRACE"); v != "" {
+			if *endpointsGrace, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid XDS_ENDPOINTS_GRACE: %s", err)
+			}
+		}
+	}
+	if *maxEndpointDrop == 0 {
+		if v := os.Getenv("XDS_MAX_ENDPOINT_DROP"); v != "" {
+			if *maxEndpointDrop, err = strconv.Atoi(v); err != nil {
+				log.Fatalf("Invalid XDS_MAX_ENDPOINT_DROP: %s", err)
+			}
+		}
+	}
+	var guard *EpGuard
+	if *endpointsGrace > 0 {
+		guard = NewEpGuard(*endpointsGrace, *maxEndpointDrop)
+	}
+
+	if *endpointsDebounce == 0 {
+		if v := os.Getenv("XDS_ENDPOINTS_DEBOUNCE"); v != "" {
+			if *endpointsDebounce, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid XDS_ENDPOINTS_DEBOUNCE: %s", err)
+			}
+		}
+	}
+	if *endpointsMaxDelay == 0 {
+		if v := os.Getenv("XDS_ENDPOINTS_MAX_DELAY"); v != "" {
+			if *endpointsMaxDelay, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid XDS_ENDPOINTS_MAX_DELAY: %s", err)
+			}
+		} else {
+			*endpointsMaxDelay = 10 * *endpointsDebounce
+		}
+	}
+	var debounce *Debouncer
+	if *endpointsDebounce > 0 {
+		debounce = NewDebouncer(*endpointsDebounce, *endpointsMaxDelay)
+	}
+
+	if *endpointsFile == "" {
+		*endpointsFile = os.Getenv("XDS_ENDPOINTS_FILE")
+	}
+
+	if *dnsServer == "" {
+		*dnsServer = os.Getenv("XDS_DNS_SERVER")
+	}
+	resolver := net.DefaultResolver
+	if *dnsServer != "" {
+		server := *dnsServer
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv("XDS_CONFIG_FILE")
+	}
+
+	opts := ControllerOptions{
+		ConfigFile:    *configFile,
+		EndpointsFile: *endpointsFile,
+		Resolver:      resolver,
+		Guard:         guard,
+		Debounce:      debounce,
+	}
+
+	// synchronously fetches initial state and sets things up
+	var c *Controller
+	if opts.ConfigFile != "" {
+		c = NewFileController(opts)
+	} else {
+		c = newK8sController(opts)
+	}
+	c.Run()
+	go serveGRPC(c)
+	if *longPoll == 0 {
+		if v := os.Getenv("XDS_LONG_POLL"); v != "" {
+			if *longPoll, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("Invalid XDS_LONG_POLL: %s", err)
+			}
+		}
+	}
+
+	serveHTTP(&xDSHandler{controller: c, longPoll: *longPoll})
+}
+
+// newK8sController sets up a Controller reading its config and endpoints
+// from Kubernetes, besides the sources already set in opts.
+func newK8sController(opts ControllerOptions) *Controller {
 	config, err := K8SConfig()
 	if err != nil {
 		log.Println(err)
 		klog.Fatal(err)
 	}
 
-	flag.Parse()
-
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		log.Println(err)
 		klog.Fatal(err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Println(err)
+		klog.Fatal(err)
+	}
+
 	if *configName == "" {
 		*configName = os.Getenv("XDS_CONFIGMAP")
 		if *configName == "" {
@@ -119,10 +277,76 @@ func runServerMode() {
 		}
 	}
 
-	// synchronously fetches initial state and sets things up
-	c := NewController(client, *configName)
-	c.Run()
-	serveHTTP(&xDSHandler{c})
+	if *configSelector == "" {
+		*configSelector = os.Getenv("XDS_CONFIG_SELECTOR")
+	}
+	if _, err := labels.Parse(*configSelector); err != nil {
+		log.Fatalf("Invalid XDS_CONFIG_SELECTOR: %s", err)
+	}
+
+	if !*crds {
+		if v := os.Getenv("XDS_CRDS"); v != "" {
+			if *crds, err = strconv.ParseBool(v); err != nil {
+				log.Fatalf("Invalid XDS_CRDS: %s", err)
+			}
+		}
+	}
+
+	if !*endpointSlices {
+		if v := os.Getenv("XDS_ENDPOINT_SLICES"); v != "" {
+			if *endpointSlices, err = strconv.ParseBool(v); err != nil {
+				log.Fatalf("Invalid XDS_ENDPOINT_SLICES: %s", err)
+			}
+		}
+	}
+
+	if !*zones {
+		if v := os.Getenv("XDS_ZONES"); v != "" {
+			if *zones, err = strconv.ParseBool(v); err != nil {
+				log.Fatalf("Invalid XDS_ZONES: %s", err)
+			}
+		}
+	}
+
+	if !*podWeights {
+		if v := os.Getenv("XDS_POD_WEIGHTS"); v != "" {
+			if *podWeights, err = strconv.ParseBool(v); err != nil {
+				log.Fatalf("Invalid XDS_POD_WEIGHTS: %s", err)
+			}
+		}
+	}
+
+	if *lbLabels == "" {
+		*lbLabels = os.Getenv("XDS_LB_LABELS")
+	}
+	var lbLabelNames []string
+	if *lbLabels != "" {
+		lbLabelNames = strings.Split(*lbLabels, ",")
+	}
+
+	if *kubeContexts == "" {
+		*kubeContexts = os.Getenv("XDS_KUBE_CONTEXTS")
+	}
+	var remotes []RemoteCluster
+	if *kubeContexts != "" {
+		for _, name := range strings.Split(*kubeContexts, ",") {
+			remote, err := NewRemoteCluster(name)
+			if err != nil {
+				log.Fatalf("Invalid XDS_KUBE_CONTEXTS: %s: %s", name, err)
+			}
+			remotes = append(remotes, remote)
+		}
+	}
+
+	opts.ConfigName = *configName
+	opts.ConfigSelector = *configSelector
+	opts.CRDs = *crds
+	opts.EndpointSlices = *endpointSlices
+	opts.Zones = *zones
+	opts.PodWeights = *podWeights
+	opts.LbLabels = lbLabelNames
+	opts.Remotes = remotes
+	return NewController(client, dynamicClient, opts)
 }
 
 func runProxyMode() {
@@ -192,6 +416,34 @@ func serveHTTP(handler http.Handler) {
 	http.ListenAndServe(*listen, handler)
 }
 
+func serveGRPC(c *Controller) {
+	if *grpcListen == "" {
+		*grpcListen = os.Getenv("XDS_GRPC_LISTEN")
+		if *grpcListen == "" {
+			// gRPC is optional, REST keeps working without it
+			return
+		}
+	}
+
+	lis, err := net.Listen("tcp", *grpcListen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(server, newADSServer(c))
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(server, newADSServerV3(c))
+	discovery.RegisterSecretDiscoveryServiceServer(server, newSDSServer(c))
+	secretv3.RegisterSecretDiscoveryServiceServer(server, newSDSServerV3(c))
+	discovery.RegisterRuntimeDiscoveryServiceServer(server, newRTDSServer(c))
+	runtimev3.RegisterRuntimeDiscoveryServiceServer(server, newRTDSServerV3(c))
+
+	log.Printf("serving ADS on %s", *grpcListen)
+	if err := server.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func validateConfig(configPath string) {
 	log.Printf("Validating: %s\n", configPath)
 	cmRaw, err := ReadFileorStdin(configPath)
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+// Nodes that haven't asked for anything in this long are forgotten
+const nodeStatusExpiry = time.Hour
+
+// TypeStatus is what a node was sent of a resource type and what it
+// made of it.
+type TypeStatus struct {
+	// Last version sent to the node
+	Sent string `json:"sent"`
+	// Last version the node accepted
+	Acked string `json:"acked"`
+	// Last version the node rejected and why
+	Rejected string `json:"rejected,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type NodeStatus struct {
+	Cluster  string                 `json:"cluster"`
+	LastSeen time.Time              `json:"last_seen"`
+	Types    map[string]*TypeStatus `json:"types"`
+}
+
+// NodeStore keeps track of what every node has been sent and
+// whether it ACKed or NACKed it, keyed by node id.
+type NodeStore struct {
+	mu    sync.Mutex
+	nodes map[string]*NodeStatus
+}
+
+func NewNodeStore() *NodeStore {
+	return &NodeStore{nodes: make(map[string]*NodeStatus)}
+}
+
+// get returns the status of a type for node, the caller must hold mu.
+func (ns *NodeStore) get(node *core.Node, typeURL string) *TypeStatus {
+	now := time.Now()
+	n, ok := ns.nodes[node.Id]
+	if !ok {
+		for id, n := range ns.nodes {
+			if now.Sub(n.LastSeen) > nodeStatusExpiry {
+				delete(ns.nodes, id)
+			}
+		}
+		n = &NodeStatus{Types: make(map[string]*TypeStatus)}
+		ns.nodes[node.Id] = n
+	}
+	n.Cluster = node.Cluster
+	n.LastSeen = now
+
+	t, ok := n.Types[typeURL]
+	if !ok {
+		t = &TypeStatus{}
+		n.Types[typeURL] = t
+	}
+	return t
+}
+
+// Sent records a version of a type sent to node.
+func (ns *NodeStore) Sent(node *core.Node, typeURL string, version string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.get(node, typeURL).Sent = version
+}
+
+// Ack records that node accepted a version of a type.
+func (ns *NodeStore) Ack(node *core.Node, typeURL string, version string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	t := ns.get(node, typeURL)
+	t.Acked = version
+	t.Rejected = ""
+	t.Error = ""
+}
+
+// Nack records that node rejected the last version of a type it was sent.
+func (ns *NodeStore) Nack(node *core.Node, typeURL string, message string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	t := ns.get(node, typeURL)
+	t.Rejected = t.Sent
+	t.Error = message
+}
+
+// Nodes returns a copy of the status of all known nodes.
+func (ns *NodeStore) Nodes() map[string]*NodeStatus {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	rv := make(map[string]*NodeStatus, len(ns.nodes))
+	for id, n := range ns.nodes {
+		types := make(map[string]*TypeStatus, len(n.Types))
+		for typeURL, t := range n.Types {
+			tc := *t
+			types[typeURL] = &tc
+		}
+		rv[id] = &NodeStatus{
+			Cluster:  n.Cluster,
+			LastSeen: n.LastSeen,
+			Types:    types,
+		}
+	}
+	return rv
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"sync"
+)
+
+// notifier lets any number of goroutines wait for the next change
+// of a store. Waiters grab the current channel, which gets closed
+// (and replaced) on every Notify call.
+type notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{ch: make(chan struct{})}
+}
+
+// Wait returns a channel that is closed on the next change.
+func (n *notifier) Wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// Notify wakes up everyone waiting for a change.
+func (n *notifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Pod annotation with the load balancing weight of its endpoints
+const weightAnnotation = "xds.sentry.io/weight"
+
+// Metadata namespace Envoy's subset load balancer matches on
+const lbMetadataKey = "envoy.lb"
+
+// podMetadata is what endpoints take over from their pod.
+type podMetadata struct {
+	weight uint32
+	labels map[string]string
+}
+
+// apply sets the weight and metadata of an endpoint of the pod.
+func (md *podMetadata) apply(lbEndpoint *endpoint.LbEndpoint) {
+	if md == nil {
+		return
+	}
+	if md.weight > 0 {
+		lbEndpoint.LoadBalancingWeight = &wrappers.UInt32Value{Value: md.weight}
+	}
+	if len(md.labels) > 0 {
+		fields := make(map[string]*structpb.Value, len(md.labels))
+		for k, v := range md.labels {
+			fields[k] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: v}}
+		}
+		lbEndpoint.Metadata = &core.Metadata{
+			FilterMetadata: map[string]*structpb.Struct{
+				lbMetadataKey: {Fields: fields},
+			},
+		}
+	}
+}
+
+// PodStore keeps the load balancing weight and selected labels of pods,
+// for the endpoints backed by them.
+type PodStore struct {
+	k8sClient *kubernetes.Clientset
+
+	informer cache.SharedIndexInformer
+
+	// Whether endpoints take the weight annotation of their pod
+	weights bool
+	// Labels copied into the metadata of endpoints
+	lbLabels []string
+
+	// Pod key -> *podMetadata, only for pods having any
+	pods sync.Map
+
+	mu sync.Mutex
+	// Keys of pods whose metadata changed since they were last taken
+	changed map[string]struct{}
+
+	updates *notifier
+}
+
+func NewPodStore(k8sClient *kubernetes.Clientset, weights bool, lbLabels []string) *PodStore {
+	ps := &PodStore{
+		k8sClient: k8sClient,
+		weights:   weights,
+		lbLabels:  lbLabels,
+		updates:   newNotifier(),
+	}
+	infFactory := informers.NewSharedInformerFactoryWithOptions(k8sClient, 0,
+		informers.WithTweakListOptions(func(*metav1.ListOptions) {}))
+
+	ps.informer = infFactory.Core().V1().Pods().Informer()
+	ps.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ps.LoadPod(obj.(*v1.Pod))
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			ps.LoadPod(cur.(*v1.Pod))
+		},
+		DeleteFunc: func(obj interface{}) {
+			// Its endpoints go away along with it
+			key, _ := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			ps.pods.Delete(key)
+		},
+	})
+	return ps
+}
+
+func (ps *PodStore) Init() error {
+	pods, err := ps.k8sClient.CoreV1().Pods(v1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		ps.LoadPod(&pods.Items[i])
+	}
+	// Endpoints are built with these in the first place
+	ps.Changed()
+	return nil
+}
+
+func (ps *PodStore) Run() {
+	ps.informer.Run(nil)
+}
+
+// LoadPod records the metadata of a pod. Pods change all the time, but
+// endpoints only need to be rebuilt if their metadata did.
+func (ps *PodStore) LoadPod(pod *v1.Pod) {
+	key := pod.GetNamespace() + "/" + pod.GetName()
+	md := ps.podMetadata(pod)
+
+	old, ok := ps.pods.Load(key)
+	switch {
+	case md == nil && !ok:
+		return
+	case md == nil:
+		ps.pods.Delete(key)
+	case ok && reflect.DeepEqual(old, md):
+		return
+	default:
+		ps.pods.Store(key, md)
+	}
+
+	ps.mu.Lock()
+	if ps.changed == nil {
+		ps.changed = make(map[string]struct{})
+	}
+	ps.changed[key] = struct{}{}
+	ps.mu.Unlock()
+	ps.updates.Notify()
+}
+
+// Changed returns the keys of the pods whose metadata changed since it
+// was last called.
+func (ps *PodStore) Changed() []string {
+	if ps == nil {
+		return nil
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	keys := make([]string, 0, len(ps.changed))
+	for key := range ps.changed {
+		keys = append(keys, key)
+	}
+	ps.changed = nil
+	return keys
+}
+
+func (ps *PodStore) podMetadata(pod *v1.Pod) *podMetadata {
+	md := &podMetadata{}
+	if v, ok := pod.Annotations[weightAnnotation]; ok && ps.weights {
+		weight, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || weight == 0 {
+			log.Printf("%s/%s: invalid %s: %q", pod.GetNamespace(), pod.GetName(), weightAnnotation, v)
+		} else {
+			md.weight = uint32(weight)
+		}
+	}
+	for _, label := range ps.lbLabels {
+		if v, ok := pod.Labels[label]; ok {
+			if md.labels == nil {
+				md.labels = make(map[string]string)
+			}
+			md.labels[label] = v
+		}
+	}
+	if md.weight == 0 && md.labels == nil {
+		return nil
+	}
+	return md
+}
+
+// Get returns the metadata of the pod ref refers to, if any.
+func (ps *PodStore) Get(ref *v1.ObjectReference) *podMetadata {
+	if ps == nil || ref == nil || ref.Kind != "Pod" {
+		return nil
+	}
+	if md, ok := ps.pods.Load(ref.Namespace + "/" + ref.Name); ok {
+		return md.(*podMetadata)
+	}
+	return nil
+}
+
+// Updates returns a channel that is closed on the next metadata change.
+func (ps *PodStore) Updates() <-chan struct{} {
+	if ps == nil {
+		return nil
+	}
+	return ps.updates.Wait()
+}
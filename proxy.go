@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -59,14 +61,23 @@ func (p *proxy) handleEDS(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
 	dr, err := readDiscoveryRequest(req)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
+	// Bootstrap data is kept per service, batches go upstream
 	if len(dr.ResourceNames) != 1 {
-		http.Error(w, "must have 1 resource_names", 400)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		p.reverseProxy.ServeHTTP(w, req)
 		return
 	}
 
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	runtimev3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
+)
+
+// Runtime Discovery Service for Envoys fetching runtime layers over
+// a dedicated gRPC stream instead of ADS.
+type rtdsServer struct {
+	ads *adsServer
+}
+
+func newRTDSServer(controller *Controller) *rtdsServer {
+	return &rtdsServer{ads: newADSServer(controller)}
+}
+
+func (s *rtdsServer) StreamRuntime(stream discovery.RuntimeDiscoveryService_StreamRuntimeServer) error {
+	return s.ads.StreamAggregatedResources(stream)
+}
+
+func (s *rtdsServer) DeltaRuntime(stream discovery.RuntimeDiscoveryService_DeltaRuntimeServer) error {
+	return s.ads.DeltaAggregatedResources(stream)
+}
+
+func (s *rtdsServer) FetchRuntime(ctx context.Context, req *v2.DiscoveryRequest) (*v2.DiscoveryResponse, error) {
+	return s.ads.fetch(req)
+}
+
+type rtdsServerV3 struct {
+	ads *adsServer
+}
+
+func newRTDSServerV3(controller *Controller) *rtdsServerV3 {
+	return &rtdsServerV3{ads: newADSServer(controller)}
+}
+
+func (s *rtdsServerV3) StreamRuntime(stream runtimev3.RuntimeDiscoveryService_StreamRuntimeServer) error {
+	return s.ads.StreamAggregatedResources(&adsStreamV3{stream})
+}
+
+func (s *rtdsServerV3) DeltaRuntime(stream runtimev3.RuntimeDiscoveryService_DeltaRuntimeServer) error {
+	return s.ads.DeltaAggregatedResources(&deltaStreamV3{stream})
+}
+
+func (s *rtdsServerV3) FetchRuntime(ctx context.Context, req *discoveryv3.DiscoveryRequest) (*discoveryv3.DiscoveryResponse, error) {
+	return s.ads.fetchV3(req)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secretv3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+)
+
+// Secret Discovery Service for Envoys fetching secrets over a
+// dedicated gRPC stream instead of ADS. The streams look exactly
+// like ADS ones, so they are served by the ADS implementation.
+type sdsServer struct {
+	ads *adsServer
+}
+
+func newSDSServer(controller *Controller) *sdsServer {
+	return &sdsServer{ads: newADSServer(controller)}
+}
+
+func (s *sdsServer) StreamSecrets(stream discovery.SecretDiscoveryService_StreamSecretsServer) error {
+	return s.ads.StreamAggregatedResources(stream)
+}
+
+func (s *sdsServer) DeltaSecrets(stream discovery.SecretDiscoveryService_DeltaSecretsServer) error {
+	return s.ads.DeltaAggregatedResources(stream)
+}
+
+func (s *sdsServer) FetchSecrets(ctx context.Context, req *v2.DiscoveryRequest) (*v2.DiscoveryResponse, error) {
+	return s.ads.fetch(req)
+}
+
+type sdsServerV3 struct {
+	ads *adsServer
+}
+
+func newSDSServerV3(controller *Controller) *sdsServerV3 {
+	return &sdsServerV3{ads: newADSServer(controller)}
+}
+
+func (s *sdsServerV3) StreamSecrets(stream secretv3.SecretDiscoveryService_StreamSecretsServer) error {
+	return s.ads.StreamAggregatedResources(&adsStreamV3{stream})
+}
+
+func (s *sdsServerV3) DeltaSecrets(stream secretv3.SecretDiscoveryService_DeltaSecretsServer) error {
+	return s.ads.DeltaAggregatedResources(&deltaStreamV3{stream})
+}
+
+func (s *sdsServerV3) FetchSecrets(ctx context.Context, req *discoveryv3.DiscoveryRequest) (*discoveryv3.DiscoveryResponse, error) {
+	return s.ads.fetchV3(req)
+}
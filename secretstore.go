@@ -0,0 +1,333 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Key of the CA bundle in secrets used as validation context
+const caCertKey = "ca.crt"
+
+// SecretStore serves Kubernetes secrets referenced by name from SDS
+// configs in listeners and clusters. Only the namespaces of referenced
+// secrets are watched.
+type SecretStore struct {
+	k8sClient *kubernetes.Clientset
+
+	// Namespace -> informer of its secrets, only touched by Init and Run
+	namespaces map[string]*secretNamespace
+
+	configStore *ConfigStore
+
+	registry sync.Map
+
+	updates *notifier
+}
+
+type secretNamespace struct {
+	informer cache.SharedIndexInformer
+	stop     chan struct{}
+}
+
+type Secret struct {
+	version    string
+	resource   *any.Any
+	resourceV3 *any.Any
+}
+
+func (s *Secret) Resource(typeURL string) *any.Any {
+	if typeURL == resourcev3.SecretType {
+		return s.resourceV3
+	}
+	return s.resource
+}
+
+func NewSecretStore(
+	k8sClient *kubernetes.Clientset,
+	configStore *ConfigStore,
+) *SecretStore {
+	return &SecretStore{
+		k8sClient:   k8sClient,
+		configStore: configStore,
+		namespaces:  make(map[string]*secretNamespace),
+		updates:     newNotifier(),
+	}
+}
+
+// newInformer sets up the informer of the secrets in a namespace.
+func (ss *SecretStore) newInformer(namespace string) cache.SharedIndexInformer {
+	infFactory := informers.NewSharedInformerFactoryWithOptions(ss.k8sClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(*metav1.ListOptions) {}))
+
+	informer := infFactory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			config := ss.configStore.GetConfigSnapshot()
+
+			key, _ := cache.MetaNamespaceKeyFunc(obj)
+			if !config.HasSecret(key) {
+				return
+			}
+
+			ss.LoadSecret(obj.(*v1.Secret))
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			config := ss.configStore.GetConfigSnapshot()
+
+			key, _ := cache.MetaNamespaceKeyFunc(cur)
+			if !config.HasSecret(key) {
+				return
+			}
+			os := old.(*v1.Secret)
+			cs := cur.(*v1.Secret)
+
+			if reflect.DeepEqual(cs.Data, os.Data) {
+				return
+			}
+
+			ss.LoadSecret(cs)
+		},
+		DeleteFunc: func(obj interface{}) {
+			config := ss.configStore.GetConfigSnapshot()
+
+			key, _ := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if !config.HasSecret(key) {
+				return
+			}
+
+			ss.DeleteSecret(key)
+		},
+	})
+	return informer
+}
+
+func (ss *SecretStore) Init() error {
+	config := ss.configStore.GetConfigSnapshot()
+	for namespace := range secretNamespaces(config) {
+		informer := ss.newInformer(namespace)
+		secrets, err := ss.k8sClient.CoreV1().Secrets(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range secrets.Items {
+			secret := &secrets.Items[i]
+			if !config.HasSecret(secret.GetNamespace() + "/" + secret.GetName()) {
+				continue
+			}
+			informer.GetStore().Add(secret)
+			ss.LoadSecret(secret)
+		}
+		ss.namespaces[namespace] = &secretNamespace{informer: informer}
+	}
+	return nil
+}
+
+func (ss *SecretStore) Run() {
+	for _, ns := range ss.namespaces {
+		ns.stop = make(chan struct{})
+		go ns.informer.Run(ns.stop)
+	}
+
+	// Secrets rarely change, so pick up the ones the configmap starts
+	// referencing right away instead of waiting for their next update.
+	for {
+		updates := ss.configStore.Updates()
+		config := ss.configStore.GetConfigSnapshot()
+		ss.watchNamespaces(config)
+		for key := range config.secrets {
+			if _, ok := ss.registry.Load(key); ok {
+				continue
+			}
+			namespace, _ := k8sSplitName(key)
+			ns, ok := ss.namespaces[namespace]
+			if !ok {
+				continue
+			}
+			if obj, exists, _ := ns.informer.GetStore().GetByKey(key); exists {
+				ss.LoadSecret(obj.(*v1.Secret))
+			}
+		}
+		<-updates
+	}
+}
+
+// watchNamespaces starts watching the namespaces config starts
+// referencing secrets in, and stops watching the others. Secrets of
+// newly watched namespaces are loaded by the informer as it lists them.
+func (ss *SecretStore) watchNamespaces(config *Config) {
+	namespaces := secretNamespaces(config)
+	for namespace := range namespaces {
+		if _, ok := ss.namespaces[namespace]; ok {
+			continue
+		}
+		ns := &secretNamespace{
+			informer: ss.newInformer(namespace),
+			stop:     make(chan struct{}),
+		}
+		go ns.informer.Run(ns.stop)
+		ss.namespaces[namespace] = ns
+	}
+	for namespace, ns := range ss.namespaces {
+		if _, ok := namespaces[namespace]; ok {
+			continue
+		}
+		close(ns.stop)
+		delete(ss.namespaces, namespace)
+	}
+}
+
+// secretNamespaces returns the namespaces of the secrets config
+// references.
+func secretNamespaces(config *Config) map[string]struct{} {
+	namespaces := make(map[string]struct{})
+	for key := range config.secrets {
+		if strings.Contains(key, "/") {
+			namespace, _ := k8sSplitName(key)
+			namespaces[namespace] = struct{}{}
+		}
+	}
+	return namespaces
+}
+
+func (ss *SecretStore) LoadSecret(secret *v1.Secret) {
+	key := secret.GetNamespace() + "/" + secret.GetName()
+	version := secret.ObjectMeta.ResourceVersion
+
+	if s, ok := ss.registry.Load(key); ok && s.(*Secret).version == version {
+		return
+	}
+
+	pb := &auth.Secret{Name: key}
+	if crt, ok := secret.Data[v1.TLSCertKey]; ok {
+		privateKey, ok := secret.Data[v1.TLSPrivateKeyKey]
+		if !ok {
+			log.Printf("secret %s: %s without %s", key, v1.TLSCertKey, v1.TLSPrivateKeyKey)
+			return
+		}
+		pb.Type = &auth.Secret_TlsCertificate{
+			TlsCertificate: &auth.TlsCertificate{
+				CertificateChain: inlineBytes(crt),
+				PrivateKey:       inlineBytes(privateKey),
+			},
+		}
+	} else if ca, ok := secret.Data[caCertKey]; ok {
+		pb.Type = &auth.Secret_ValidationContext{
+			ValidationContext: &auth.CertificateValidationContext{
+				TrustedCa: inlineBytes(ca),
+			},
+		}
+	} else {
+		log.Printf("secret %s: needs either %s and %s or %s", key, v1.TLSCertKey, v1.TLSPrivateKeyKey, caCertKey)
+		return
+	}
+
+	pbV3, err := toV3(pb)
+	if err != nil {
+		log.Printf("secret %s: %s", key, err)
+		return
+	}
+	r, _ := ptypes.MarshalAny(pb)
+	rV3, _ := ptypes.MarshalAny(pbV3)
+
+	log.Println("loading secret: " + key)
+	ss.registry.Store(key, &Secret{
+		version:    version,
+		resource:   r,
+		resourceV3: rV3,
+	})
+	ss.updates.Notify()
+}
+
+func (ss *SecretStore) DeleteSecret(key string) {
+	log.Println("removing secret: " + key)
+	ss.registry.Delete(key)
+	ss.updates.Notify()
+}
+
+func (ss *SecretStore) Get(key string) (*Secret, bool) {
+	if s, ok := ss.registry.Load(key); ok {
+		return s.(*Secret), true
+	}
+	return nil, false
+}
+
+// Updates returns a channel that is closed on the next secrets change.
+func (ss *SecretStore) Updates() <-chan struct{} {
+	return ss.updates.Wait()
+}
+
+// GetResponse returns a DiscoveryResponse with every known secret in names.
+func (ss *SecretStore) GetResponse(typeURL string, names []string) *v2.DiscoveryResponse {
+	resources := make([]*any.Any, 0, len(names))
+	versions := make([]string, 0, len(names))
+	for _, name := range names {
+		s, ok := ss.Get(name)
+		if !ok {
+			continue
+		}
+		resources = append(resources, s.Resource(typeURL))
+		versions = append(versions, name+"="+s.version)
+	}
+	return &v2.DiscoveryResponse{
+		VersionInfo: combineVersions(versions),
+		Resources:   resources,
+		TypeUrl:     typeURL,
+	}
+}
+
+// GetResources returns every known secret in names keyed by name,
+// for incremental xDS.
+func (ss *SecretStore) GetResources(typeURL string, names []string) map[string]*v2.Resource {
+	rv := make(map[string]*v2.Resource, len(names))
+	for _, name := range names {
+		if s, ok := ss.Get(name); ok {
+			rv[name] = &v2.Resource{
+				Name:     name,
+				Version:  s.version,
+				Resource: s.Resource(typeURL),
+			}
+		}
+	}
+	return rv
+}
+
+func inlineBytes(b []byte) *core.DataSource {
+	return &core.DataSource{
+		Specifier: &core.DataSource_InlineBytes{InlineBytes: b},
+	}
+}
+
+// findSecretNames returns the names of all secrets referenced
+// through SDS configs in pb.
+func findSecretNames(pb proto.Message) []string {
+	names := make([]string, 0)
+	rangeMessages(proto.MessageV2(pb).ProtoReflect(), func(m protoreflect.Message) {
+		switch m.Descriptor().FullName() {
+		case "envoy.api.v2.auth.SdsSecretConfig",
+			"envoy.extensions.transport_sockets.tls.v3.SdsSecretConfig":
+			name := m.Get(m.Descriptor().Fields().ByName("name")).String()
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	})
+	return names
+}
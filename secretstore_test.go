@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSecretsRestrictedByAssignment(t *testing.T) {
+	c := newTestController(t)
+	err := c.configStore.Load(&v1.ConfigMap{
+		Data: map[string]string{
+			"listeners": `
+- name: foo
+  address:
+    socket_address:
+      address: 0.0.0.0
+      port_value: 443
+  filter_chains:
+  - transport_socket:
+      name: envoy.transport_sockets.tls
+      typed_config:
+        '@type': type.googleapis.com/envoy.api.v2.auth.DownstreamTlsContext
+        common_tls_context:
+          tls_certificate_sds_secret_configs:
+          - name: default/foo-cert
+            sds_config: {ads: {}}
+`,
+			"assignments": `
+by-cluster:
+  foo:
+    listeners: [foo]
+  bar: {}
+`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := c.GetConfigSnapshot()
+	if !config.HasSecret("default/foo-cert") {
+		t.Fatal("expected default/foo-cert to be referenced")
+	}
+
+	c.secretStore.LoadSecret(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "foo-cert",
+			ResourceVersion: "1",
+		},
+		Data: map[string][]byte{
+			v1.TLSCertKey:       []byte("cert"),
+			v1.TLSPrivateKeyKey: []byte("key"),
+		},
+	})
+
+	names := []string{"default/foo-cert"}
+	resp, _ := c.GetResponse(resource.SecretType, &core.Node{Cluster: "foo"}, names)
+	if len(resp.Resources) != 1 {
+		t.Fatalf("expected the secret, got %v", resp.Resources)
+	}
+
+	resp, _ = c.GetResponse(resource.SecretType, &core.Node{Cluster: "bar"}, names)
+	if len(resp.Resources) != 0 {
+		t.Fatalf("bar must not get foo's secret, got %v", resp.Resources)
+	}
+}
+
+func TestSecretNamespaces(t *testing.T) {
+	config := NewConfig()
+	config.secrets["default/foo-cert"] = struct{}{}
+	config.secrets["snuba/ca"] = struct{}{}
+	config.secrets["snuba/tls"] = struct{}{}
+	config.secrets["invalid"] = struct{}{}
+
+	namespaces := secretNamespaces(config)
+	if len(namespaces) != 2 {
+		t.Fatalf("expected default and snuba, got %v", namespaces)
+	}
+	for _, namespace := range []string{"default", "snuba"} {
+		if _, ok := namespaces[namespace]; !ok {
+			t.Fatalf("expected %s to be watched, got %v", namespace, namespaces)
+		}
+	}
+
+	// Nothing to watch without secrets
+	ss := NewSecretStore(nil, &ConfigStore{config: NewConfig()})
+	if err := ss.Init(); err != nil || len(ss.namespaces) != 0 {
+		t.Fatalf("expected no namespaces to be watched, got %v %v", ss.namespaces, err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// serviceEntry declares a service proxied on a local port, generating
+// the listener and the EDS cluster of the `services` section:
+//
+//	services: |
+//	  - service: default/snuba
+//	    port: 10001
+//	    protocol: http
+//
+// Both are named after the Kubernetes service, or name if set, and are
+// assigned like hand written ones.
+type serviceEntry struct {
+	Name     string `json:"name,omitempty"`
+	Service  string `json:"service"`
+	Port     uint32 `json:"port"`
+	Protocol string `json:"protocol"`
+	// Defaults to 127.0.0.1
+	Address string `json:"address,omitempty"`
+	// Defaults to 0.25s
+	ConnectTimeout string `json:"connect_timeout,omitempty"`
+	// Route configuration served by RDS, with http only. Defaults to
+	// routing everything to the cluster.
+	Route string `json:"route,omitempty"`
+	// Timeout of redis commands, with redis only. Defaults to 5s.
+	OpTimeout string `json:"op_timeout,omitempty"`
+	// Config source of EDS and RDS, defaults to polling xds_cluster
+	// over REST
+	ConfigSource map[string]interface{} `json:"config_source,omitempty"`
+}
+
+// defaultConfigSource polls xds_cluster over REST, as the examples do.
+func defaultConfigSource() map[string]interface{} {
+	return map[string]interface{}{
+		"api_config_source": map[string]interface{}{
+			"api_type":      "REST",
+			"cluster_names": []interface{}{"xds_cluster"},
+			"refresh_delay": "1s",
+		},
+	}
+}
+
+func extractServices(cm *v1.ConfigMap) ([]*serviceEntry, error) {
+	var services []*serviceEntry
+	if err := yaml.UnmarshalStrict([]byte(cm.Data["services"]), &services); err != nil {
+		return nil, errors.New("services: invalid YAML: " + err.Error())
+	}
+	for i, s := range services {
+		if s.Name == "" {
+			if strings.HasPrefix(s.Service, dnsSRVPrefix) || strings.Count(s.Service, "/") != 1 {
+				return nil, fmt.Errorf("services: index %d: name required", i)
+			}
+			_, s.Name = k8sSplitName(s.Service)
+		}
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("services: %s: %s", s.Name, err)
+		}
+		if s.Address == "" {
+			s.Address = "127.0.0.1"
+		}
+		if s.ConnectTimeout == "" {
+			s.ConnectTimeout = "0.25s"
+		}
+		if s.OpTimeout == "" && s.Protocol == "redis" {
+			s.OpTimeout = "5s"
+		}
+		if s.ConfigSource == nil {
+			s.ConfigSource = defaultConfigSource()
+		}
+	}
+	return services, nil
+}
+
+func (s *serviceEntry) validate() error {
+	if s.Service == "" {
+		return errors.New("service required")
+	}
+	if s.Port == 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", s.Port)
+	}
+	switch s.Protocol {
+	case "tcp", "redis":
+		if s.Route != "" {
+			return fmt.Errorf("route requires protocol http, not %s", s.Protocol)
+		}
+	case "http":
+	default:
+		return fmt.Errorf("protocol must be tcp, http or redis, not %q", s.Protocol)
+	}
+	if s.OpTimeout != "" && s.Protocol != "redis" {
+		return fmt.Errorf("op_timeout requires protocol redis, not %s", s.Protocol)
+	}
+	return nil
+}
+
+// Resources returns the listener and the cluster of the service.
+func (s *serviceEntry) Resources() (*v2.Listener, *v2.Cluster, error) {
+	var listener v2.Listener
+	if err := convertToPb(s.listener(), &listener); err != nil {
+		return nil, nil, err
+	}
+	var cluster v2.Cluster
+	if err := convertToPb(s.cluster(), &cluster); err != nil {
+		return nil, nil, err
+	}
+	return &listener, &cluster, nil
+}
+
+func (s *serviceEntry) cluster() map[string]interface{} {
+	return map[string]interface{}{
+		"name":            s.Name,
+		"type":            "EDS",
+		"connect_timeout": s.ConnectTimeout,
+		"eds_cluster_config": map[string]interface{}{
+			"service_name": s.Service,
+			"eds_config":   s.ConfigSource,
+		},
+	}
+}
+
+func (s *serviceEntry) listener() map[string]interface{} {
+	return map[string]interface{}{
+		"name": s.Name,
+		"address": map[string]interface{}{
+			"socket_address": map[string]interface{}{
+				"address":    s.Address,
+				"port_value": s.Port,
+			},
+		},
+		"filter_chains": []interface{}{
+			map[string]interface{}{
+				"filters": []interface{}{s.filter()},
+			},
+		},
+	}
+}
+
+func (s *serviceEntry) filter() map[string]interface{} {
+	switch s.Protocol {
+	case "http":
+		manager := map[string]interface{}{
+			"@type":       "type.googleapis.com/envoy.config.filter.network.http_connection_manager.v2.HttpConnectionManager",
+			"stat_prefix": s.Name,
+			"http_filters": []interface{}{
+				map[string]interface{}{"name": "envoy.filters.http.router"},
+			},
+		}
+		if s.Route != "" {
+			manager["rds"] = map[string]interface{}{
+				"route_config_name": s.Route,
+				"config_source":     s.ConfigSource,
+			}
+		} else {
+			manager["route_config"] = map[string]interface{}{
+				"name": s.Name,
+				"virtual_hosts": []interface{}{
+					map[string]interface{}{
+						"name":    s.Name,
+						"domains": []interface{}{"*"},
+						"routes": []interface{}{
+							map[string]interface{}{
+								"match": map[string]interface{}{"prefix": "/"},
+								"route": map[string]interface{}{"cluster": s.Name},
+							},
+						},
+					},
+				},
+			}
+		}
+		return map[string]interface{}{
+			"name":         "envoy.filters.network.http_connection_manager",
+			"typed_config": manager,
+		}
+	case "redis":
+		return map[string]interface{}{
+			"name": "envoy.filters.network.redis_proxy",
+			"typed_config": map[string]interface{}{
+				"@type":       "type.googleapis.com/envoy.config.filter.network.redis_proxy.v2.RedisProxy",
+				"stat_prefix": s.Name,
+				"settings":    map[string]interface{}{"op_timeout": s.OpTimeout},
+				"prefix_routes": map[string]interface{}{
+					"catch_all_route": map[string]interface{}{"cluster": s.Name},
+				},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"name": "envoy.filters.network.tcp_proxy",
+		"typed_config": map[string]interface{}{
+			"@type":       "type.googleapis.com/envoy.config.filter.network.tcp_proxy.v2.TcpProxy",
+			"stat_prefix": s.Name,
+			"cluster":     s.Name,
+		},
+	}
+}
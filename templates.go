@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Key of resources declared as an instance of a template, all other
+// keys are its parameters
+const templateKey = "template"
+
+// Placeholder of a parameter in a template, e.g. `{{service}}`
+var templateParam = regexp.MustCompile(`{{\s*([A-Za-z0-9_-]+)\s*}}`)
+
+// Templates are named listeners or clusters with placeholders, expanded
+// into the resources declared as instances of them:
+//
+//	templates: |
+//	  eds-tcp:
+//	    connect_timeout: 0.25s
+//	    type: EDS
+//	    eds_cluster_config:
+//	      service_name: "{{service}}"
+//	      eds_config:
+//	        ads: {}
+//	clusters: |
+//	  - {template: eds-tcp, name: foo, service: default/foo}
+//
+// A string that is a placeholder only is replaced by the parameter as
+// is, otherwise the parameter is formatted into it. The name parameter
+// is the name of the resource, it need not be used by the template.
+type Templates map[string]interface{}
+
+func extractTemplates(cm *v1.ConfigMap) (Templates, error) {
+	var templates Templates
+	if err := yaml.Unmarshal([]byte(cm.Data["templates"]), &templates); err != nil {
+		return nil, errors.New("templates: invalid YAML: " + err.Error())
+	}
+	return templates, nil
+}
+
+// Expand returns the resource r is an instance of, r itself if it isn't
+// an instance of a template.
+func (templates Templates) Expand(r interface{}) (interface{}, error) {
+	params, ok := r.(map[string]interface{})
+	if !ok {
+		return r, nil
+	}
+	value, ok := params[templateKey]
+	if !ok {
+		return r, nil
+	}
+	name, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid template: %v", value)
+	}
+	template, ok := templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template: %s", name)
+	}
+
+	used := make(map[string]bool)
+	expanded, err := substitute(template, params, used)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %s", name, err)
+	}
+	var unused []string
+	for param := range params {
+		if param != templateKey && param != "name" && !used[param] {
+			unused = append(unused, param)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return nil, fmt.Errorf("template %s: unused parameters: %v", name, unused)
+	}
+
+	if resourceName, ok := params["name"]; ok {
+		resource, ok := expanded.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("template %s: not an object", name)
+		}
+		resource["name"] = resourceName
+	}
+	return expanded, nil
+}
+
+// substitute returns a copy of value with its placeholders replaced by
+// params, recording the ones used.
+func substitute(value interface{}, params map[string]interface{}, used map[string]bool) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		rv := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			field, err := substitute(field, params, used)
+			if err != nil {
+				return nil, err
+			}
+			rv[key] = field
+		}
+		return rv, nil
+	case []interface{}:
+		rv := make([]interface{}, len(v))
+		for i, item := range v {
+			item, err := substitute(item, params, used)
+			if err != nil {
+				return nil, err
+			}
+			rv[i] = item
+		}
+		return rv, nil
+	case string:
+		var missing []string
+		lookup := func(name string) interface{} {
+			param, ok := params[name]
+			if !ok || name == templateKey {
+				missing = append(missing, name)
+				return ""
+			}
+			used[name] = true
+			return param
+		}
+		if m := templateParam.FindStringSubmatch(v); m != nil && m[0] == v {
+			param := lookup(m[1])
+			if len(missing) > 0 {
+				return nil, fmt.Errorf("missing parameter: %s", m[1])
+			}
+			return param, nil
+		}
+		rv := templateParam.ReplaceAllStringFunc(v, func(placeholder string) string {
+			name := templateParam.FindStringSubmatch(placeholder)[1]
+			return fmt.Sprint(lookup(name))
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("missing parameter: %s", missing[0])
+		}
+		return rv, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	zoneLabel   = "topology.kubernetes.io/zone"
+	regionLabel = "topology.kubernetes.io/region"
+	// Deprecated, but still set by older clusters
+	betaZoneLabel   = "failure-domain.beta.kubernetes.io/zone"
+	betaRegionLabel = "failure-domain.beta.kubernetes.io/region"
+	hostnameLabel   = "kubernetes.io/hostname"
+)
+
+type locality struct {
+	region string
+	zone   string
+}
+
+// topologyLocality reads the locality out of topology labels, as set
+// on Nodes and copied into EndpointSlices.
+func topologyLocality(topology map[string]string) locality {
+	l := locality{
+		region: topology[regionLabel],
+		zone:   topology[zoneLabel],
+	}
+	if l.region == "" {
+		l.region = topology[betaRegionLabel]
+	}
+	if l.zone == "" {
+		l.zone = topology[betaZoneLabel]
+	}
+	return l
+}
+
+func (l locality) Locality() *core.Locality {
+	if l == (locality{}) {
+		return nil
+	}
+	return &core.Locality{Region: l.region, Zone: l.zone}
+}
+
+// TopologyStore knows the locality of every Node, so that endpoints
+// can be grouped by zone for zone aware load balancing.
+type TopologyStore struct {
+	k8sClient *kubernetes.Clientset
+
+	informer cache.SharedIndexInformer
+
+	// Node name -> locality
+	localities sync.Map
+
+	updates *notifier
+}
+
+func NewTopologyStore(k8sClient *kubernetes.Clientset) *TopologyStore {
+	ts := &TopologyStore{
+		k8sClient: k8sClient,
+		updates:   newNotifier(),
+	}
+	infFactory := informers.NewSharedInformerFactoryWithOptions(k8sClient, 0,
+		informers.WithTweakListOptions(func(*metav1.ListOptions) {}))
+
+	ts.informer = infFactory.Core().V1().Nodes().Informer()
+	ts.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ts.LoadNode(obj.(*v1.Node))
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			ts.LoadNode(cur.(*v1.Node))
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, _ := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			ts.localities.Delete(key)
+			ts.updates.Notify()
+		},
+	})
+	return ts
+}
+
+func (ts *TopologyStore) Init() error {
+	nodes, err := ts.k8sClient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range nodes.Items {
+		ts.LoadNode(&nodes.Items[i])
+	}
+	return nil
+}
+
+func (ts *TopologyStore) Run() {
+	ts.informer.Run(nil)
+}
+
+// LoadNode records the locality of a node. Endpoints only need to be
+// regrouped if it changed, which is rare.
+func (ts *TopologyStore) LoadNode(node *v1.Node) {
+	l := topologyLocality(node.Labels)
+	if old, ok := ts.localities.Load(node.Name); ok && old.(locality) == l {
+		return
+	}
+	ts.localities.Store(node.Name, l)
+	ts.updates.Notify()
+}
+
+// Get returns the locality of a node, which is empty for unknown ones.
+func (ts *TopologyStore) Get(nodeName string) locality {
+	if ts == nil {
+		return locality{}
+	}
+	if l, ok := ts.localities.Load(nodeName); ok {
+		return l.(locality)
+	}
+	return locality{}
+}
+
+// Updates returns a channel that is closed on the next locality change.
+func (ts *TopologyStore) Updates() <-chan struct{} {
+	if ts == nil {
+		return nil
+	}
+	return ts.updates.Wait()
+}
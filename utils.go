@@ -3,10 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
 	"strings"
 
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
 	"sigs.k8s.io/yaml"
 )
 
@@ -27,6 +37,20 @@ func convertToPb(data interface{}, pb proto.Message) error {
 	return jsonpb.Unmarshal(bytes.NewReader(j), pb)
 }
 
+// Resources in the configmap may be written against the v2 or the v3 API.
+// Either way they are kept as v2, v3 only fields survive as unknown fields
+// and are restored when translated back to v3.
+func convertToPbAnyVersion(data interface{}, pb proto.Message, pbV3 proto.Message) error {
+	err := convertToPb(data, pb)
+	if err == nil {
+		return nil
+	}
+	if errV3 := convertToPb(data, pbV3); errV3 != nil {
+		return fmt.Errorf("%s (as v3: %s)", err, errV3)
+	}
+	return convertMessage(pbV3, pb)
+}
+
 func structToJSON(pb proto.Message) ([]byte, error) {
 	var b bytes.Buffer
 	if err := (&jsonpb.Marshaler{OrigName: true}).Marshal(&b, pb); err != nil {
@@ -47,3 +71,114 @@ func k8sSplitName(name string) (string, string) {
 	s := strings.SplitN(name, "/", 2)
 	return s[0], s[1]
 }
+
+// Combine several resource versions into a single, order independent one
+func combineVersions(versions []string) string {
+	sorted := append([]string(nil), versions...)
+	sort.Strings(sorted)
+	h := fnv.New64a()
+	for _, v := range sorted {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// Version of a set of resources, derived from their own versions
+func resourcesVersion(resources []*v2.Resource) string {
+	versions := make([]string, len(resources))
+	for i, r := range resources {
+		versions[i] = r.Name + "=" + r.Version
+	}
+	return combineVersions(versions)
+}
+
+// Hash of the serialized message, used as version of a single resource
+func contentVersion(pb proto.Message) string {
+	b, _ := protov2.MarshalOptions{Deterministic: true}.Marshal(proto.MessageV2(pb))
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// Wrap a message into a named and versioned xDS resource
+func newResource(name string, pb proto.Message) *v2.Resource {
+	r, _ := ptypes.MarshalAny(pb)
+	return &v2.Resource{
+		Name:     name,
+		Version:  contentVersion(pb),
+		Resource: r,
+	}
+}
+
+func resourcesToAny(resources []*v2.Resource) []*any.Any {
+	rv := make([]*any.Any, len(resources))
+	for i, r := range resources {
+		rv[i] = r.Resource
+	}
+	return rv
+}
+
+// Keep only resources with one of the given names
+func filterResources(resources []*v2.Resource, names []string) []*v2.Resource {
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[name] = struct{}{}
+	}
+	rv := make([]*v2.Resource, 0, len(names))
+	for _, r := range resources {
+		if _, ok := wanted[r.Name]; ok {
+			rv = append(rv, r)
+		}
+	}
+	return rv
+}
+
+// Call fn for m and every message nested in it, looking into
+// Any fields of known types as well.
+func rangeMessages(m protoreflect.Message, fn func(protoreflect.Message)) {
+	fn(m)
+
+	if a, ok := m.Interface().(*anypb.Any); ok {
+		mt, err := protoregistry.GlobalTypes.FindMessageByURL(a.TypeUrl)
+		if err != nil {
+			return
+		}
+		inner := mt.New().Interface()
+		if err := protov2.Unmarshal(a.Value, inner); err == nil {
+			rangeMessages(inner.ProtoReflect(), fn)
+		}
+		return
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					rangeMessages(mv.Message(), fn)
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				l := v.List()
+				for i := 0; i < l.Len(); i++ {
+					rangeMessages(l.Get(i).Message(), fn)
+				}
+			}
+		case fd.Message() != nil:
+			rangeMessages(v.Message(), fn)
+		}
+		return true
+	})
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
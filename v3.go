@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	annotations "github.com/cncf/udpa/go/udpa/annotations"
+	v2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Resources are kept as v2 internally and translated into v3 when
+// served. v3 keeps the wire format of v2, so messages are converted by
+// re-encoding them, then embedded Any messages and config sources are
+// upgraded as well. The v2 -> v3 type mapping comes from the versioning
+// annotations of the v3 protos.
+
+var (
+	v3TypesOnce sync.Once
+	// v2 message name -> v3 message type
+	v3Types map[protoreflect.FullName]protoreflect.MessageType
+)
+
+func loadV3Types() {
+	v3Types = make(map[protoreflect.FullName]protoreflect.MessageType)
+	protoregistry.GlobalTypes.RangeMessages(func(mt protoreflect.MessageType) bool {
+		if !strings.Contains(string(mt.Descriptor().FullName()), ".v3.") {
+			return true
+		}
+		opts := mt.Descriptor().Options()
+		if opts == nil {
+			return true
+		}
+		ext, err := proto.GetExtension(proto.MessageV1(opts), annotations.E_Versioning)
+		if err != nil {
+			return true
+		}
+		if prev := ext.(*annotations.VersioningAnnotation).PreviousMessageType; prev != "" {
+			v3Types[protoreflect.FullName(prev)] = mt
+		}
+		return true
+	})
+}
+
+// toV3 converts a v2 message into its v3 counterpart.
+func toV3(pb proto.Message) (proto.Message, error) {
+	v3TypesOnce.Do(loadV3Types)
+
+	m := proto.MessageV2(pb)
+	if _, ok := v3Types[m.ProtoReflect().Descriptor().FullName()]; !ok {
+		return nil, fmt.Errorf("no v3 type for %s", m.ProtoReflect().Descriptor().FullName())
+	}
+	m, err := upgrade(m)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MessageV1(m), nil
+}
+
+// Re-encode a message as another, wire compatible, type.
+func convertMessage(from, to proto.Message) error {
+	b, err := protov2.MarshalOptions{Deterministic: true}.Marshal(proto.MessageV2(from))
+	if err != nil {
+		return err
+	}
+	return protov2.Unmarshal(b, proto.MessageV2(to))
+}
+
+func upgrade(m protov2.Message) (protov2.Message, error) {
+	if mt, ok := v3Types[m.ProtoReflect().Descriptor().FullName()]; ok {
+		upgraded := mt.New().Interface()
+		if err := convertMessage(proto.MessageV1(m), proto.MessageV1(upgraded)); err != nil {
+			return nil, err
+		}
+		m = upgraded
+	}
+	if err := upgradeFields(m.ProtoReflect()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// upgradeFields walks all set fields of m and upgrades whatever still
+// refers to the v2 API.
+func upgradeFields(m protoreflect.Message) error {
+	switch pb := m.Interface().(type) {
+	case *anypb.Any:
+		return upgradeAny(pb)
+	case *corev3.ConfigSource:
+		if pb.ResourceApiVersion == corev3.ApiVersion_AUTO {
+			pb.ResourceApiVersion = corev3.ApiVersion_V3
+		}
+	case *corev3.ApiConfigSource:
+		if pb.TransportApiVersion == corev3.ApiVersion_AUTO {
+			pb.TransportApiVersion = corev3.ApiVersion_V3
+		}
+	}
+
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					err = upgradeFields(mv.Message())
+					return err == nil
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				l := v.List()
+				for i := 0; i < l.Len() && err == nil; i++ {
+					err = upgradeFields(l.Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			err = upgradeFields(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
+
+func upgradeAny(a *anypb.Any) error {
+	mt, err := protoregistry.GlobalTypes.FindMessageByURL(a.TypeUrl)
+	if err != nil {
+		// Not something we know about, pass it through untouched
+		return nil
+	}
+	m := mt.New().Interface()
+	if err := protov2.Unmarshal(a.Value, m); err != nil {
+		return err
+	}
+	if m, err = upgrade(m); err != nil {
+		return err
+	}
+	b, err := protov2.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	a.TypeUrl = "type.googleapis.com/" + string(m.ProtoReflect().Descriptor().FullName())
+	a.Value = b
+	return nil
+}
+
+// The v3 Aggregated Discovery Service shares the implementation of the
+// v2 one; requests and responses are converted on the stream.
+type adsServerV3 struct {
+	ads *adsServer
+}
+
+func newADSServerV3(controller *Controller) *adsServerV3 {
+	return &adsServerV3{ads: newADSServer(controller)}
+}
+
+func (s *adsServerV3) StreamAggregatedResources(stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	return s.ads.StreamAggregatedResources(&adsStreamV3{stream})
+}
+
+func (s *adsServerV3) DeltaAggregatedResources(stream discoveryv3.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return s.ads.DeltaAggregatedResources(&deltaStreamV3{stream})
+}
+
+func (s *adsServer) fetchV3(req *discoveryv3.DiscoveryRequest) (*discoveryv3.DiscoveryResponse, error) {
+	var reqV2 v2.DiscoveryRequest
+	if err := convertMessage(req, &reqV2); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp, err := s.fetch(&reqV2)
+	if err != nil {
+		return nil, err
+	}
+	var out discoveryv3.DiscoveryResponse
+	return &out, convertMessage(resp, &out)
+}
+
+type adsStreamV3 struct {
+	discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+}
+
+func (s *adsStreamV3) Send(resp *v2.DiscoveryResponse) error {
+	var out discoveryv3.DiscoveryResponse
+	if err := convertMessage(resp, &out); err != nil {
+		return err
+	}
+	return s.AggregatedDiscoveryService_StreamAggregatedResourcesServer.Send(&out)
+}
+
+func (s *adsStreamV3) Recv() (*v2.DiscoveryRequest, error) {
+	req, err := s.AggregatedDiscoveryService_StreamAggregatedResourcesServer.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var out v2.DiscoveryRequest
+	return &out, convertMessage(req, &out)
+}
+
+type deltaStreamV3 struct {
+	discoveryv3.AggregatedDiscoveryService_DeltaAggregatedResourcesServer
+}
+
+func (s *deltaStreamV3) Send(resp *v2.DeltaDiscoveryResponse) error {
+	var out discoveryv3.DeltaDiscoveryResponse
+	if err := convertMessage(resp, &out); err != nil {
+		return err
+	}
+	return s.AggregatedDiscoveryService_DeltaAggregatedResourcesServer.Send(&out)
+}
+
+func (s *deltaStreamV3) Recv() (*v2.DeltaDiscoveryRequest, error) {
+	req, err := s.AggregatedDiscoveryService_DeltaAggregatedResourcesServer.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var out v2.DeltaDiscoveryRequest
+	return &out, convertMessage(req, &out)
+}
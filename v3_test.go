@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestConfigServesV3(t *testing.T) {
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"listeners": `
+- name: foo
+  address:
+    socket_address:
+      address: 0.0.0.0
+      port_value: 10001
+  filter_chains:
+  - filters:
+    - name: envoy.tcp_proxy
+      typed_config:
+        '@type': type.googleapis.com/envoy.config.filter.network.tcp_proxy.v2.TcpProxy
+        cluster: foo
+        stat_prefix: foo
+`,
+			// Only valid as v3, track_cluster_stats does not exist in v2
+			"clusters": `
+- name: foo
+  type: EDS
+  connect_timeout: 0.25s
+  track_cluster_stats:
+    timeout_budgets: true
+  eds_cluster_config:
+    service_name: default/foo
+    eds_config:
+      api_config_source:
+        api_type: GRPC
+        grpc_services:
+        - envoy_grpc:
+            cluster_name: xds_cluster
+`,
+			"assignments": `
+by-cluster:
+  foo:
+    listeners: [foo]
+    clusters: [foo]
+`,
+		},
+	}
+
+	config := NewConfig()
+	if err := config.Load(cm); err != nil {
+		t.Fatal(err)
+	}
+	if !config.HasService("default/foo") {
+		t.Fatal("v3 cluster should register its EDS service")
+	}
+
+	node := &core.Node{Cluster: "foo"}
+	listeners, ok := config.GetJSON(resourcev3.ListenerType, node)
+	if !ok {
+		t.Fatal("missing v3 listeners")
+	}
+	for _, expected := range []string{
+		"type.googleapis.com/envoy.config.listener.v3.Listener",
+		"type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy",
+	} {
+		if !strings.Contains(string(listeners), expected) {
+			t.Errorf("expected %s in %s", expected, listeners)
+		}
+	}
+
+	clusters, _ := config.GetJSON(resourcev3.ClusterType, node)
+	for _, expected := range []string{
+		"type.googleapis.com/envoy.config.cluster.v3.Cluster",
+		`"resource_api_version":"V3"`,
+		`"transport_api_version":"V3"`,
+		`"timeout_budgets":true`,
+	} {
+		if !strings.Contains(string(clusters), expected) {
+			t.Errorf("expected %s in %s", expected, clusters)
+		}
+	}
+}